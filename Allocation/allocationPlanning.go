@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+type ProposedAllocation struct { // One berth assignment a planner wants to try
+	BookingID string `json:"bookingID"`
+	BerthCode string `json:"berthCode"`
+	ETB       string `json:"etb"` // RFC3339
+	ETD       string `json:"etd"` // RFC3339
+}
+
+type PlannedVessel struct { // Outcome of a proposal for one vessel
+	BookingID      string   `json:"bookingID"`
+	VesselID       string   `json:"vesselID"`
+	RotationNumber string   `json:"rotationNumber"`
+	BerthCode      string   `json:"berthCode"`
+	ETB            string   `json:"etb"`
+	ETD            string   `json:"etd"`
+	WaitingHours   float64  `json:"waitingHours"` // proposed ETB minus requested ETB, never negative
+	Issues         []string `json:"issues"`
+}
+
+type PlannedBerth struct { // Utilisation of one berth over the planning horizon
+	BerthCode     string  `json:"berthCode"`
+	OccupiedHours float64 `json:"occupiedHours"`
+	IdleHours     float64 `json:"idleHours"`
+}
+
+type PlanConflict struct { // Two windows that cannot share a berth
+	BerthCode     string `json:"berthCode"`
+	BookingID     string `json:"bookingID"`
+	ConflictsWith string `json:"conflictsWith"` // booking ID of another proposal, or rotation number of an approved booking
+}
+
+type AllocationPlan struct { // Result of plan_allocation
+	Feasible     bool            `json:"feasible"`
+	HorizonStart string          `json:"horizonStart"`
+	HorizonEnd   string          `json:"horizonEnd"`
+	Vessels      []PlannedVessel `json:"vessels"`
+	Berths       []PlannedBerth  `json:"berths"`
+	Conflicts    []PlanConflict  `json:"conflicts"`
+}
+
+type window struct {
+	start time.Time
+	end   time.Time
+}
+
+// byStart orders windows by their start time
+type byStart []window
+
+func (w byStart) Len() int           { return len(w) }
+func (w byStart) Swap(i, j int)      { w[i], w[j] = w[j], w[i] }
+func (w byStart) Less(i, j int) bool { return w[i].start.Before(w[j].start) }
+
+// ============================================================================================================================
+// occupiedHours - hours covered by at least one window once the windows are clipped to the horizon
+// ============================================================================================================================
+func occupiedHours(windows []window, horizon window) float64 {
+	clipped := []window{}
+	for _, w := range windows {
+		if w.start.Before(horizon.start) {
+			w.start = horizon.start
+		}
+		if w.end.After(horizon.end) {
+			w.end = horizon.end
+		}
+		if w.end.After(w.start) {
+			clipped = append(clipped, w)
+		}
+	}
+	sort.Sort(byStart(clipped))
+	var total time.Duration
+	var current *window
+	for i := range clipped {
+		w := clipped[i]
+		if current != nil && !w.start.After(current.end) {
+			if w.end.After(current.end) {
+				current.end = w.end
+			}
+			continue
+		}
+		if current != nil {
+			total += current.end.Sub(current.start)
+		}
+		current = &w
+	}
+	if current != nil {
+		total += current.end.Sub(current.start)
+	}
+	return total.Hours()
+}
+
+// ============================================================================================================================
+// plan_allocation - read-only what-if evaluation of a set of proposed berth assignments. Nothing is written to
+// the ledger; the answer lists conflicts, berth idle time over the plan horizon and waiting time per vessel.
+// ============================================================================================================================
+func (t *ManageAllocations) plan_allocation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting a JSON array of proposals")
+	}
+	fmt.Println("start plan_allocation")
+	VesselChaincode, BerthChainCode, err := chaincodeRefs(stub)
+	if err != nil {
+		return nil, err
+	}
+	var proposals []ProposedAllocation
+	err = json.Unmarshal([]byte(args[0]), &proposals)
+	if err != nil || len(proposals) == 0 {
+		return nil, newError(ERR_INVALID_ARGUMENT, "Proposals must be a non-empty JSON array of {bookingID, berthCode, etb, etd}")
+	}
+
+	plan := AllocationPlan{Vessels: []PlannedVessel{}, Berths: []PlannedBerth{}, Conflicts: []PlanConflict{}}
+	windows := make([]*window, len(proposals))
+	planned := make(map[string]bool)
+	for _, proposal := range proposals {
+		planned[proposal.BookingID] = true
+	}
+	masters := make(map[string]BerthMaster)
+	occupying := make(map[string][]Berth)
+	var horizon *window
+
+	for i, proposal := range proposals {
+		vessel := PlannedVessel{BookingID: proposal.BookingID, BerthCode: proposal.BerthCode, ETB: proposal.ETB, ETD: proposal.ETD, Issues: []string{}}
+		start, startErr := time.Parse(time.RFC3339, proposal.ETB)
+		end, endErr := time.Parse(time.RFC3339, proposal.ETD)
+		if startErr != nil || endErr != nil || !end.After(start) {
+			vessel.Issues = append(vessel.Issues, "proposed window must be RFC3339 with ETD after ETB")
+		} else {
+			windows[i] = &window{start, end}
+			if horizon == nil {
+				horizon = &window{start, end}
+			}
+			if start.Before(horizon.start) {
+				horizon.start = start
+			}
+			if end.After(horizon.end) {
+				horizon.end = end
+			}
+		}
+
+		booking, err := fetchBooking(stub, BerthChainCode, proposal.BookingID)
+		if err != nil {
+			vessel.Issues = append(vessel.Issues, err.Error())
+			plan.Vessels = append(plan.Vessels, vessel)
+			continue
+		}
+		vessel.VesselID = booking.VesselID
+		vessel.RotationNumber = booking.RotationNumber
+		requested, err := time.Parse(time.RFC3339, booking.RequestedETB)
+		if err == nil && windows[i] != nil && windows[i].start.After(requested) {
+			vessel.WaitingHours = windows[i].start.Sub(requested).Hours()
+		}
+
+		master, ok := masters[proposal.BerthCode]
+		if !ok {
+			master, err = fetchBerthMaster(stub, BerthChainCode, proposal.BerthCode)
+			if err != nil {
+				vessel.Issues = append(vessel.Issues, err.Error())
+				plan.Vessels = append(plan.Vessels, vessel)
+				continue
+			}
+			masters[proposal.BerthCode] = master
+			occupying[proposal.BerthCode], err = fetchOccupyingBookings(stub, BerthChainCode, proposal.BerthCode)
+			if err != nil {
+				return nil, err
+			}
+		}
+		vesselData, err := fetchVessel(stub, VesselChaincode, booking.VesselID)
+		if err != nil {
+			vessel.Issues = append(vessel.Issues, err.Error())
+		} else {
+			vessel.Issues = append(vessel.Issues, checkVesselFitsBerth(vesselData, master)...)
+		}
+		vessel.Issues = append(vessel.Issues, checkBerthTerminal(booking, master)...)
+
+		// Conflicts with bookings already approved on the berth and not part of this plan
+		if windows[i] != nil {
+			for _, other := range occupying[proposal.BerthCode] {
+				if planned[other.BookingID] {
+					continue
+				}
+				otherStart, otherEnd, err := bookingWindow(other)
+				if err == nil && windows[i].start.Before(otherEnd) && otherStart.Before(windows[i].end) {
+					plan.Conflicts = append(plan.Conflicts, PlanConflict{proposal.BerthCode, proposal.BookingID, other.RotationNumber})
+				}
+			}
+		}
+		plan.Vessels = append(plan.Vessels, vessel)
+	}
+
+	// Conflicts between the proposals themselves
+	for i := range proposals {
+		for j := i + 1; j < len(proposals); j++ {
+			if windows[i] == nil || windows[j] == nil || proposals[i].BerthCode != proposals[j].BerthCode {
+				continue
+			}
+			if windows[i].start.Before(windows[j].end) && windows[j].start.Before(windows[i].end) {
+				plan.Conflicts = append(plan.Conflicts, PlanConflict{proposals[i].BerthCode, proposals[i].BookingID, proposals[j].BookingID})
+			}
+		}
+	}
+
+	// Idle time of every berth used by the plan, over the plan horizon
+	if horizon != nil {
+		plan.HorizonStart = horizon.start.Format(time.RFC3339)
+		plan.HorizonEnd = horizon.end.Format(time.RFC3339)
+		berthCodes := []string{}
+		for berthCode := range masters {
+			berthCodes = append(berthCodes, berthCode)
+		}
+		sort.Strings(berthCodes)
+		for _, berthCode := range berthCodes {
+			used := []window{}
+			for i, proposal := range proposals {
+				if proposal.BerthCode == berthCode && windows[i] != nil {
+					used = append(used, *windows[i])
+				}
+			}
+			for _, other := range occupying[berthCode] {
+				otherStart, otherEnd, err := bookingWindow(other)
+				if err == nil && !planned[other.BookingID] {
+					used = append(used, window{otherStart, otherEnd})
+				}
+			}
+			occupied := occupiedHours(used, *horizon)
+			plan.Berths = append(plan.Berths, PlannedBerth{berthCode, occupied, horizon.end.Sub(horizon.start).Hours() - occupied})
+		}
+	}
+
+	plan.Feasible = len(plan.Conflicts) == 0
+	for _, vessel := range plan.Vessels {
+		if len(vessel.Issues) > 0 {
+			plan.Feasible = false
+		}
+	}
+	planAsBytes, _ := json.Marshal(plan)
+	fmt.Println("end plan_allocation")
+	return planAsBytes, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/util"
+)
+
+type BookingView struct { // A booking with its allocations, oldest allocation first
+	Booking     Berth              `json:"booking"`
+	Allocations []AllocationRecord `json:"allocations"`
+}
+
+type VesselView struct { // Everything recorded about one vessel across the Vessel, Berth and Allocation chaincodes
+	Vessel   Vessel        `json:"vessel"`
+	Bookings []BookingView `json:"bookings"` // ordered by booking ID
+}
+
+// ============================================================================================================================
+// getAllocations_pendingApproval - get the allocations confirmed by their terminal operator and awaiting the port authority
+// ============================================================================================================================
+func (t *ManageAllocations) getAllocations_pendingApproval(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting no arguments")
+	}
+	return queryAllocations(stub, "status", []string{STATUS_CONFIRMED})
+}
+
+// ============================================================================================================================
+// getAllocations_byApprover - get the allocations approved or rejected by an approver, MSP ID / certificate subject
+// ============================================================================================================================
+func (t *ManageAllocations) getAllocations_byApprover(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return queryAllocations(stub, "approver", args)
+}
+
+// ============================================================================================================================
+// getAllocations_byBerthAndDate - get the allocations of a berth whose window touches a day, YYYY-MM-DD in UTC
+// ============================================================================================================================
+func (t *ManageAllocations) getAllocations_byBerthAndDate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting berth code and date")
+	}
+	fmt.Println("start getAllocations_byBerthAndDate")
+	_, err := time.Parse("2006-01-02", args[1])
+	if err != nil {
+		return nil, fieldError("date", "Date must be given as YYYY-MM-DD")
+	}
+	allocations, err := findAllocations(stub, "date", args[1])
+	if err != nil {
+		return nil, err
+	}
+	onBerth := []AllocationRecord{}
+	for _, res := range allocations {
+		if res.BerthCode == args[0] {
+			onBerth = append(onBerth, res)
+		}
+	}
+	fmt.Println("end getAllocations_byBerthAndDate")
+	return json.Marshal(onBerth)
+}
+
+// ============================================================================================================================
+// get_vesselView - get a vessel, its bookings and their allocations in one answer
+// ============================================================================================================================
+func (t *ManageAllocations) get_vesselView(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting VesselID")
+	}
+	fmt.Println("start get_vesselView")
+
+	// Alloting Params
+	VesselID := args[0]
+
+	//-----------------------------------------------------------------------------
+
+	// Vessel and Berth chaincodes configured by the admin
+	VesselChaincode, BerthChainCode, err := chaincodeRefs(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch Vessel details from Blockchain
+	VesselData, err := fetchVessel(stub, VesselChaincode, VesselID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch the vessel's bookings from Blockchain
+	f := "getBerth_byVesselID"
+	queryArgs := util.ToChaincodeArgs(f, VesselID)
+	bookingsAsBytes, err := unwrapResponse(stub.QueryChaincode(BerthChainCode, queryArgs))
+	if err != nil {
+		errStr := fmt.Sprintf("Failed to query chaincode. Got error: %s", err.Error())
+		fmt.Printf(errStr)
+		return nil, remoteError(errStr, err)
+	}
+	bookings := make(map[string]Berth)
+	err = json.Unmarshal(bookingsAsBytes, &bookings)
+	if err != nil {
+		return nil, errors.New("Malformed bookings returned by the Berth chaincode")
+	}
+
+	// Attach the allocations of each booking
+	allocations, err := findAllocations(stub, "vessel", VesselID)
+	if err != nil {
+		return nil, err
+	}
+	var bookingIDs []string
+	for bookingID := range bookings {
+		bookingIDs = append(bookingIDs, bookingID)
+	}
+	sort.Strings(bookingIDs)
+	view := VesselView{Vessel: VesselData, Bookings: []BookingView{}}
+	for _, bookingID := range bookingIDs {
+		booking := BookingView{Booking: bookings[bookingID], Allocations: []AllocationRecord{}}
+		for _, res := range allocations {
+			if res.BookingID == bookingID {
+				booking.Allocations = append(booking.Allocations, res)
+			}
+		}
+		view.Bookings = append(view.Bookings, booking)
+	}
+	fmt.Println("end get_vesselView")
+	return json.Marshal(view)
+}
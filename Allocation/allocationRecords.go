@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var AllocationPrefix = "_Allocation_"          //prefix for allocation record keys
+var CurrentAllocationPrefix = "_AllocCurrent_" //booking ID -> ID of the booking's latest allocation
+
+// Secondary indexes are stored as composite keys
+//
+//	_AllocIdx <sep> index name <sep> value <sep> allocation ID
+//
+// so every allocation with a given value sits in one contiguous key range
+var AllocationIndexPrefix = "_AllocIdx"
+var IndexSeparator = "\x00"
+
+// An allocation is indexed on every day its window touches, up to this many days
+var maxIndexedDays = 62
+
+type AllocationAction struct { // One step taken on an allocation
+	Action      string `json:"action"` // the Allocation function that took it
+	Status      string `json:"status"` // booking status once it was taken
+	Actor       string `json:"actor"`
+	TxID        string `json:"txID"`
+	TxTimestamp string `json:"txTimestamp"`
+	Remarks     string `json:"remarks"`
+}
+
+type AllocationRecord struct { // One allocation of a berth and window to a booking
+	AllocationID   string             `json:"allocationID"`
+	BookingID      string             `json:"bookingID"`
+	VesselID       string             `json:"vesselID"`
+	AgentRefNumber string             `json:"agentRefNumber"`
+	Terminal       string             `json:"terminal"`
+	BerthCode      string             `json:"berthCode"`
+	ETB            string             `json:"etb"`
+	ETD            string             `json:"etd"`
+	Status         string             `json:"status"`
+	ApproverID     string             `json:"approverID"`
+	CreatedBy      string             `json:"createdBy"`
+	CreatedAt      string             `json:"createdAt"`
+	LastModifiedBy string             `json:"lastModifiedBy"`
+	LastModifiedAt string             `json:"lastModifiedAt"`
+	Actions        []AllocationAction `json:"actions"` // oldest first
+}
+
+type allocationFieldIndex struct { // A secondary index over one allocation field
+	name   string
+	values func(AllocationRecord) []string
+}
+
+var allocationIndexes = []allocationFieldIndex{
+	{"booking", func(res AllocationRecord) []string { return []string{res.BookingID} }},
+	{"vessel", func(res AllocationRecord) []string { return []string{res.VesselID} }},
+	{"berth", func(res AllocationRecord) []string { return []string{res.BerthCode} }},
+	{"status", func(res AllocationRecord) []string { return []string{res.Status} }},
+	{"approver", func(res AllocationRecord) []string { return []string{res.ApproverID} }},
+	{"date", allocationDays},
+}
+
+// byWindow orders allocations by berthing time, then allocation ID
+type byWindow []AllocationRecord
+
+func (a byWindow) Len() int      { return len(a) }
+func (a byWindow) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byWindow) Less(i, j int) bool {
+	if a[i].ETB != a[j].ETB {
+		return a[i].ETB < a[j].ETB
+	}
+	return a[i].AllocationID < a[j].AllocationID
+}
+
+// ============================================================================================================================
+// allocationDays - the UTC days, YYYY-MM-DD, an allocation's window touches
+// ============================================================================================================================
+func allocationDays(res AllocationRecord) []string {
+	start, err := time.Parse(time.RFC3339, res.ETB)
+	if err != nil {
+		return nil
+	}
+	end, err := time.Parse(time.RFC3339, res.ETD)
+	if err != nil || end.Before(start) {
+		end = start
+	}
+	var days []string
+	day := time.Date(start.UTC().Year(), start.UTC().Month(), start.UTC().Day(), 0, 0, 0, 0, time.UTC)
+	for !day.After(end.UTC()) && len(days) < maxIndexedDays {
+		days = append(days, day.Format("2006-01-02"))
+		day = day.AddDate(0, 0, 1)
+	}
+	return days
+}
+
+// ============================================================================================================================
+// allocationIndexPrefix - start of the key range holding every allocation with the given value in an index
+// ============================================================================================================================
+func allocationIndexPrefix(name string, value string) string {
+	return AllocationIndexPrefix + IndexSeparator + name + IndexSeparator + value + IndexSeparator
+}
+
+// ============================================================================================================================
+// updateAllocationIndexes - move an allocation's index entries from its old field values to its new ones
+// ============================================================================================================================
+func updateAllocationIndexes(stub shim.ChaincodeStubInterface, old *AllocationRecord, res AllocationRecord) error {
+	for _, index := range allocationIndexes {
+		newValues := make(map[string]bool)
+		for _, value := range index.values(res) {
+			if value != "" {
+				newValues[value] = true
+			}
+		}
+		oldValues := make(map[string]bool)
+		if old != nil {
+			for _, value := range index.values(*old) {
+				if value != "" {
+					oldValues[value] = true
+				}
+			}
+		}
+		for value := range oldValues {
+			if !newValues[value] {
+				err := stub.DelState(allocationIndexPrefix(index.name, value) + res.AllocationID)
+				if err != nil {
+					return errors.New("Failed to remove " + index.name + " index entry for " + res.AllocationID)
+				}
+			}
+		}
+		for value := range newValues {
+			if !oldValues[value] {
+				err := stub.PutState(allocationIndexPrefix(index.name, value)+res.AllocationID, []byte(res.AllocationID))
+				if err != nil {
+					return errors.New("Failed to write " + index.name + " index entry for " + res.AllocationID)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// lookupAllocationIndex - get the allocation IDs recorded under a value of an index, in key order
+// ============================================================================================================================
+func lookupAllocationIndex(stub shim.ChaincodeStubInterface, name string, value string) ([]string, error) {
+	prefix := allocationIndexPrefix(name, value)
+	keysIter, err := stub.RangeQueryState(prefix, prefix+string(utf8.MaxRune))
+	if err != nil {
+		return nil, errors.New("Failed to scan " + name + " index")
+	}
+	defer keysIter.Close()
+	allocationIDs := []string{}
+	for keysIter.HasNext() {
+		key, _, err := keysIter.Next()
+		if err != nil {
+			return nil, errors.New("Failed to scan " + name + " index")
+		}
+		allocationIDs = append(allocationIDs, key[len(prefix):])
+	}
+	return allocationIDs, nil
+}
+
+// ============================================================================================================================
+// getAllocation - read an allocation record, returns nil when the allocation ID is unknown
+// ============================================================================================================================
+func getAllocation(stub shim.ChaincodeStubInterface, allocationID string) (*AllocationRecord, error) {
+	allocationAsBytes, err := stub.GetState(AllocationPrefix + allocationID)
+	if err != nil {
+		return nil, errors.New("Failed to get state for allocation " + allocationID)
+	}
+	if allocationAsBytes == nil {
+		return nil, nil
+	}
+	res := AllocationRecord{}
+	err = json.Unmarshal(allocationAsBytes, &res)
+	if err != nil {
+		return nil, errors.New("Corrupt allocation record " + allocationID)
+	}
+	return &res, nil
+}
+
+// ============================================================================================================================
+// getCurrentAllocation - the latest allocation of a booking, nil when it has none
+// ============================================================================================================================
+func getCurrentAllocation(stub shim.ChaincodeStubInterface, bookingID string) (*AllocationRecord, error) {
+	allocationID, err := stub.GetState(CurrentAllocationPrefix + bookingID)
+	if err != nil {
+		return nil, errors.New("Failed to get current allocation of " + bookingID)
+	}
+	if allocationID == nil {
+		return nil, nil
+	}
+	return getAllocation(stub, string(allocationID))
+}
+
+// ============================================================================================================================
+// recordAllocation - write an allocation action to the booking's current allocation. berth_allocation and
+// auto_allocate open a new allocation when the booking has none or its last one was declined; other actions on a
+// booking allocated before allocations were recorded open one too. BerthData carries the booking as it stands after
+// the action.
+// ============================================================================================================================
+func recordAllocation(stub shim.ChaincodeStubInterface, BerthData Berth, action string, remarks string) (AllocationRecord, error) {
+	actor, err := getActor(stub)
+	if err != nil {
+		return AllocationRecord{}, err
+	}
+	current, err := getCurrentAllocation(stub, BerthData.BookingID)
+	if err != nil {
+		return AllocationRecord{}, err
+	}
+	starts := action == "berth_allocation" || action == "auto_allocate"
+	var res AllocationRecord
+	if current == nil || (starts && current.Status == STATUS_DECLINED) {
+		previous, err := lookupAllocationIndex(stub, "booking", BerthData.BookingID)
+		if err != nil {
+			return AllocationRecord{}, err
+		}
+		res = AllocationRecord{
+			AllocationID: BerthData.BookingID + "-A" + strconv.Itoa(len(previous)+1),
+			CreatedBy:    actor.ID(),
+			CreatedAt:    actor.Time,
+		}
+		current = nil
+	} else {
+		res = *current
+	}
+	res.BookingID = BerthData.BookingID
+	res.VesselID = BerthData.VesselID
+	res.AgentRefNumber = BerthData.AgentRefNumber
+	res.Terminal = BerthData.Terminal
+	res.BerthCode = BerthData.AllocatedBerth
+	res.ETB = BerthData.AllocatedETB
+	res.ETD = BerthData.AllocatedETD
+	res.Status = BerthData.BerthBookingStatus
+	res.ApproverID = BerthData.ApproverID
+	res.LastModifiedBy = actor.ID()
+	res.LastModifiedAt = actor.Time
+	res.Actions = append(res.Actions, AllocationAction{
+		Action:      action,
+		Status:      res.Status,
+		Actor:       actor.ID(),
+		TxID:        stub.GetTxID(),
+		TxTimestamp: actor.Time,
+		Remarks:     remarks,
+	})
+	allocationAsBytes, _ := json.Marshal(res)
+	err = stub.PutState(AllocationPrefix+res.AllocationID, allocationAsBytes)
+	if err != nil {
+		return res, err
+	}
+	err = stub.PutState(CurrentAllocationPrefix+res.BookingID, []byte(res.AllocationID))
+	if err != nil {
+		return res, err
+	}
+	return res, updateAllocationIndexes(stub, current, res)
+}
+
+// ============================================================================================================================
+// booking - the booking fields the access checks look at
+// ============================================================================================================================
+func (res AllocationRecord) booking() Berth {
+	return Berth{BookingID: res.BookingID, AgentRefNumber: res.AgentRefNumber, Terminal: res.Terminal}
+}
+
+// ============================================================================================================================
+// findAllocations - the allocations recorded under a value of an index that the caller may see, ordered by window
+// ============================================================================================================================
+func findAllocations(stub shim.ChaincodeStubInterface, name string, value string) ([]AllocationRecord, error) {
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	allocationIDs, err := lookupAllocationIndex(stub, name, value)
+	if err != nil {
+		return nil, err
+	}
+	allocations := []AllocationRecord{}
+	for _, allocationID := range allocationIDs {
+		res, err := getAllocation(stub, allocationID)
+		if err != nil {
+			return nil, err
+		}
+		if res != nil && caller.canSee(res.booking()) {
+			allocations = append(allocations, *res)
+		}
+	}
+	sort.Sort(byWindow(allocations))
+	return allocations, nil
+}
+
+// ============================================================================================================================
+// queryAllocations - answer a query for the allocations under one value of an index
+// ============================================================================================================================
+func queryAllocations(stub shim.ChaincodeStubInterface, name string, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting the " + name + " to query")
+	}
+	fmt.Println("start query of allocations by " + name)
+	allocations, err := findAllocations(stub, name, args[0])
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("end query of allocations by " + name)
+	return json.Marshal(allocations)
+}
+
+// ============================================================================================================================
+// getAllocation_byID - get one allocation record
+// ============================================================================================================================
+func (t *ManageAllocations) getAllocation_byID(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting ID of the allocation to query")
+	}
+	res, err := getAllocation(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, newError(ERR_NOT_FOUND, "Allocation "+args[0]+" not found")
+	}
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = checkBookingAccess(caller, res.booking())
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(res)
+}
+
+// ============================================================================================================================
+// getAllocations_byBooking - get every allocation of a booking
+// ============================================================================================================================
+func (t *ManageAllocations) getAllocations_byBooking(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return queryAllocations(stub, "booking", args)
+}
+
+// ============================================================================================================================
+// getAllocations_byVessel - get every allocation of a vessel
+// ============================================================================================================================
+func (t *ManageAllocations) getAllocations_byVessel(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return queryAllocations(stub, "vessel", args)
+}
+
+// ============================================================================================================================
+// getAllocations_byBerth - get every allocation of a berth
+// ============================================================================================================================
+func (t *ManageAllocations) getAllocations_byBerth(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return queryAllocations(stub, "berth", args)
+}
+
+// ============================================================================================================================
+// getAllocations_byStatus - get every allocation whose booking is in a status
+// ============================================================================================================================
+func (t *ManageAllocations) getAllocations_byStatus(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return queryAllocations(stub, "status", args)
+}
+
+// ============================================================================================================================
+// getAllocations_byDate - get every allocation whose window touches a day, YYYY-MM-DD in UTC
+// ============================================================================================================================
+func (t *ManageAllocations) getAllocations_byDate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) == 1 {
+		_, err := time.Parse("2006-01-02", args[0])
+		if err != nil {
+			return nil, fieldError("date", "Date must be given as YYYY-MM-DD")
+		}
+	}
+	return queryAllocations(stub, "date", args)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/util"
+)
+
+type BerthCandidate struct { // One berth considered by the assignment engine
+	BerthCode   string   `json:"berthCode"`
+	Terminal    string   `json:"terminal"`
+	Accepted    bool     `json:"accepted"`
+	Preferred   bool     `json:"preferred"`
+	SpareLength float64  `json:"spareLength"` // quay length left over once the vessel is alongside
+	Reasons     []string `json:"reasons"`
+}
+
+type AutoAllocation struct { // Result of auto_allocate
+	BookingID      string           `json:"bookingID"`
+	AllocatedBerth string           `json:"allocatedBerth"`
+	AllocatedETB   string           `json:"allocatedETB"`
+	AllocatedETD   string           `json:"allocatedETD"`
+	Candidates     []BerthCandidate `json:"candidates"`
+}
+
+// byRank orders candidates best first: accepted berths, the preferred berth, the tightest fit, then berth code
+type byRank []BerthCandidate
+
+func (c byRank) Len() int      { return len(c) }
+func (c byRank) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byRank) Less(i, j int) bool {
+	if c[i].Accepted != c[j].Accepted {
+		return c[i].Accepted
+	}
+	if c[i].Preferred != c[j].Preferred {
+		return c[i].Preferred
+	}
+	if c[i].SpareLength != c[j].SpareLength {
+		return c[i].SpareLength < c[j].SpareLength
+	}
+	return c[i].BerthCode < c[j].BerthCode
+}
+
+// ============================================================================================================================
+// fetchBerthMaster - get a physical berth from the registry kept by the Berth chaincode
+// ============================================================================================================================
+func fetchBerthMaster(stub shim.ChaincodeStubInterface, BerthChainCode string, BerthCode string) (BerthMaster, error) {
+	BerthMasterData := BerthMaster{}
+	f := "getBerthMaster_byCode"
+	queryArgs := util.ToChaincodeArgs(f, BerthCode)
+	masterAsBytes, err := unwrapResponse(stub.QueryChaincode(BerthChainCode, queryArgs))
+	if err != nil && !hasCode(err, ERR_NOT_FOUND) {
+		errStr := fmt.Sprintf("Failed to query chaincode. Got error: %s", err.Error())
+		fmt.Printf(errStr)
+		return BerthMasterData, remoteError(errStr, err)
+	}
+	json.Unmarshal(masterAsBytes, &BerthMasterData)
+	if BerthMasterData.BerthCode != BerthCode {
+		return BerthMasterData, newError(ERR_NOT_FOUND, "Berth "+BerthCode+" does not exist in the berth registry")
+	}
+	return BerthMasterData, nil
+}
+
+// ============================================================================================================================
+// checkVesselFitsBerth - every reason why a vessel cannot use a berth, empty when it fits.
+// A limit of zero on the berth means the limit is not recorded and is not enforced.
+// ============================================================================================================================
+func checkVesselFitsBerth(vessel Vessel, berth BerthMaster) []string {
+	var reasons []string
+	if !berth.Active {
+		reasons = append(reasons, "berth "+berth.BerthCode+" is retired")
+	}
+	if berth.MaxLOA > 0 && vessel.LOA > berth.MaxLOA {
+		reasons = append(reasons, "LOA "+metres(vessel.LOA)+" exceeds berth limit "+metres(berth.MaxLOA))
+	}
+	if berth.QuayLength > 0 && vessel.LOA > berth.QuayLength {
+		reasons = append(reasons, "LOA "+metres(vessel.LOA)+" exceeds quay length "+metres(berth.QuayLength))
+	}
+	if berth.MaxDraft > 0 && vessel.Draft > berth.MaxDraft {
+		reasons = append(reasons, "draft "+metres(vessel.Draft)+" exceeds berth limit "+metres(berth.MaxDraft))
+	}
+	if len(berth.AllowedVesselTypes) > 0 {
+		allowed := false
+		for _, vesselType := range berth.AllowedVesselTypes {
+			if vesselType == vessel.VesselType {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			reasons = append(reasons, "vessel type '"+vessel.VesselType+"' is not allowed at berth "+berth.BerthCode)
+		}
+	}
+	return reasons
+}
+
+// ============================================================================================================================
+// checkBerthTerminal - why a booking cannot use a berth of another terminal, empty when the terminals match
+// ============================================================================================================================
+func checkBerthTerminal(booking Berth, berth BerthMaster) []string {
+	if berth.Terminal != booking.Terminal {
+		return []string{"berth is on terminal '" + berth.Terminal + "', booking is for terminal '" + booking.Terminal + "'"}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// metres - format a length for messages, e.g. 14.2m
+// ============================================================================================================================
+func metres(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64) + "m"
+}
+
+// ============================================================================================================================
+// fetchAllBerthMasters - get the whole berth registry kept by the Berth chaincode
+// ============================================================================================================================
+func fetchAllBerthMasters(stub shim.ChaincodeStubInterface, BerthChainCode string) (map[string]BerthMaster, error) {
+	masters := make(map[string]BerthMaster)
+	f := "get_AllBerthMaster"
+	queryArgs := util.ToChaincodeArgs(f)
+	mastersAsBytes, err := unwrapResponse(stub.QueryChaincode(BerthChainCode, queryArgs))
+	if err != nil {
+		errStr := fmt.Sprintf("Failed to query chaincode. Got error: %s", err.Error())
+		fmt.Printf(errStr)
+		return nil, remoteError(errStr, err)
+	}
+	err = json.Unmarshal(mastersAsBytes, &masters)
+	if err != nil {
+		return nil, errors.New("Failed to read the berth registry")
+	}
+	return masters, nil
+}
+
+// ============================================================================================================================
+// rankBerths - judge every registered berth for a booking and window, best candidate first
+// ============================================================================================================================
+func rankBerths(stub shim.ChaincodeStubInterface, BerthChainCode string, booking Berth, vessel Vessel, start time.Time, end time.Time) ([]BerthCandidate, error) {
+	masters, err := fetchAllBerthMasters(stub, BerthChainCode)
+	if err != nil {
+		return nil, err
+	}
+	candidates := []BerthCandidate{}
+	for _, master := range masters {
+		candidate := BerthCandidate{
+			BerthCode: master.BerthCode,
+			Terminal:  master.Terminal,
+			Preferred: master.BerthCode == booking.PreferredBerth,
+		}
+		if master.QuayLength > 0 {
+			candidate.SpareLength = master.QuayLength - vessel.LOA
+		}
+		rejections := checkVesselFitsBerth(vessel, master)
+		rejections = append(rejections, checkBerthTerminal(booking, master)...)
+		if master.Active {
+			conflicts, err := findBerthConflicts(stub, BerthChainCode, master.BerthCode, booking.BookingID, start, end)
+			if err != nil {
+				return nil, err
+			}
+			if len(conflicts) > 0 {
+				rejections = append(rejections, "already approved for an overlapping window to rotation number(s): "+strings.Join(conflicts, ", "))
+			}
+		}
+		if len(rejections) > 0 {
+			candidate.Reasons = rejections
+		} else {
+			candidate.Accepted = true
+			if candidate.Preferred {
+				candidate.Reasons = append(candidate.Reasons, "preferred berth")
+			}
+			candidate.Reasons = append(candidate.Reasons, "vessel fits and the berth is free for the requested window")
+			if master.QuayLength > 0 {
+				candidate.Reasons = append(candidate.Reasons, metres(candidate.SpareLength)+" of quay length to spare")
+			}
+		}
+		candidates = append(candidates, candidate)
+	}
+	sort.Sort(byRank(candidates))
+	return candidates, nil
+}
+
+// ============================================================================================================================
+// auto_allocate - pick the best free berth for a booking's requested window and write it to the booking
+// ============================================================================================================================
+func (t *ManageAllocations) auto_allocate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting BookingID")
+	}
+	fmt.Println("start auto_allocate")
+
+	// Alloting Params
+	BookingID := args[0]
+
+	//-----------------------------------------------------------------------------
+
+	// Vessel and Berth chaincodes configured by the admin
+	VesselChaincode, BerthChainCode, err := chaincodeRefs(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch Berth booking details from Blockchain
+	BerthData, err := fetchBooking(stub, BerthChainCode, BookingID)
+	if err != nil {
+		return nil, err
+	}
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = checkBookingAccess(caller, BerthData)
+	if err != nil {
+		return nil, err
+	}
+	if BerthData.BerthBookingStatus != STATUS_NEW && BerthData.BerthBookingStatus != STATUS_IN_PROGRESS && BerthData.BerthBookingStatus != STATUS_DECLINED {
+		return nil, newError(ERR_CONFLICT, "Booking "+BookingID+" is '"+BerthData.BerthBookingStatus+"' and can no longer be allocated")
+	}
+
+	// Fetch Vessel details from Blockchain
+	VesselData, err := fetchVessel(stub, VesselChaincode, BerthData.VesselID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rank every registered berth for the requested window
+	start, err := time.Parse(time.RFC3339, BerthData.RequestedETB)
+	if err != nil {
+		return nil, newError(ERR_CONFLICT, "Booking "+BookingID+" has no valid requested ETB")
+	}
+	end, err := time.Parse(time.RFC3339, BerthData.RequestedETD)
+	if err != nil {
+		return nil, newError(ERR_CONFLICT, "Booking "+BookingID+" has no valid requested ETD")
+	}
+	candidates, err := rankBerths(stub, BerthChainCode, BerthData, VesselData, start, end)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 || !candidates[0].Accepted {
+		var summary []string
+		for _, candidate := range candidates {
+			summary = append(summary, candidate.BerthCode+": "+strings.Join(candidate.Reasons, "; "))
+		}
+		return nil, newError(ERR_CONFLICT, "No berth available for booking "+BookingID+". "+strings.Join(summary, " | "))
+	}
+
+	// Write the chosen berth back to the booking
+	result := AutoAllocation{
+		BookingID:      BookingID,
+		AllocatedBerth: candidates[0].BerthCode,
+		AllocatedETB:   BerthData.RequestedETB,
+		AllocatedETD:   BerthData.RequestedETD,
+		Candidates:     candidates,
+	}
+	f := "update_berth_allocation"
+	invokeArgs := util.ToChaincodeArgs(f, BookingID, result.AllocatedBerth, result.AllocatedETB, result.AllocatedETD)
+	_, err = unwrapResponse(stub.InvokeChaincode(BerthChainCode, invokeArgs))
+	if err != nil {
+		errStr := fmt.Sprintf("Failed to update allocated berth from 'Berth' chaincode. Got error: %s", err.Error())
+		fmt.Printf(errStr)
+		return nil, remoteError(errStr, err)
+	}
+	fmt.Println("Allocated berth " + result.AllocatedBerth + " to booking " + BookingID)
+
+	// Record the step on the booking's allocation
+	BerthData.AllocatedBerth = result.AllocatedBerth
+	BerthData.AllocatedETB = result.AllocatedETB
+	BerthData.AllocatedETD = result.AllocatedETD
+	_, err = recordAllocation(stub, BerthData, "auto_allocate", "")
+	if err != nil {
+		return nil, err
+	}
+
+	resultAsBytes, _ := json.Marshal(result)
+	err = stub.SetEvent("evtsender", resultAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("end auto_allocate")
+	return resultAsBytes, nil
+}
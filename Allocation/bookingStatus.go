@@ -0,0 +1,72 @@
+package main
+
+// Booking lifecycle shared by the Vessel, Berth and Allocation chaincodes.
+// Keep the three copies of this table in step.
+var STATUS_NEW = "New"
+var STATUS_IN_PROGRESS = "In Progress"
+var STATUS_CONFIRMED = "Confirmed" // terminal operator accepted the allocation, awaiting the port authority
+var STATUS_DECLINED = "Declined"   // terminal operator refused the allocation, it may be allocated again
+var STATUS_APPROVED = "Approved"
+var STATUS_REJECTED = "Rejected"
+var STATUS_BERTHED = "Berthed"
+var STATUS_DEPARTED = "Departed"
+var STATUS_CANCELLED = "Cancelled"
+
+var bookingTransitions = map[string][]string{
+	STATUS_NEW:         {STATUS_IN_PROGRESS, STATUS_CANCELLED},
+	STATUS_IN_PROGRESS: {STATUS_CONFIRMED, STATUS_DECLINED, STATUS_REJECTED, STATUS_CANCELLED},
+	STATUS_CONFIRMED:   {STATUS_APPROVED, STATUS_REJECTED, STATUS_CANCELLED},
+	STATUS_DECLINED:    {STATUS_IN_PROGRESS, STATUS_CANCELLED},
+	STATUS_APPROVED:    {STATUS_BERTHED, STATUS_CANCELLED},
+	STATUS_BERTHED:     {STATUS_DEPARTED},
+	STATUS_REJECTED:    {},
+	STATUS_DEPARTED:    {},
+	STATUS_CANCELLED:   {},
+}
+
+// ============================================================================================================================
+// checkStatusTransition - make sure a booking may move from one status to another
+// ============================================================================================================================
+func checkStatusTransition(from string, to string) error {
+	if from == "" {
+		from = STATUS_NEW
+	}
+	allowed, ok := bookingTransitions[from]
+	if !ok {
+		return newError(ERR_INVALID_ARGUMENT, "Unknown booking status '"+from+"'")
+	}
+	if _, ok := bookingTransitions[to]; !ok {
+		return newError(ERR_INVALID_ARGUMENT, "Unknown booking status '"+to+"'")
+	}
+	for _, status := range allowed {
+		if status == to {
+			return nil
+		}
+	}
+	return newError(ERR_CONFLICT, "Illegal booking status transition from '"+from+"' to '"+to+"'")
+}
+
+// ============================================================================================================================
+// finishedStatus - a booking in this status is over and no longer holds its vessel
+// ============================================================================================================================
+func finishedStatus(status string) bool {
+	return status == STATUS_REJECTED || status == STATUS_DEPARTED || status == STATUS_CANCELLED
+}
+
+// ============================================================================================================================
+// checkVesselStatusTransition - a vessel carries the status of the booking that holds it. That booking moves the
+// vessel through the booking lifecycle, a vessel no booking holds is taken by the next booking that moves and a
+// vessel held by another booking is left alone. Same rule as the Vessel chaincode.
+// ============================================================================================================================
+func checkVesselStatusTransition(res Vessel, bookingID string, to string) error {
+	if res.ActiveBookingID == "" {
+		if _, ok := bookingTransitions[to]; !ok {
+			return newError(ERR_INVALID_ARGUMENT, "Unknown booking status '"+to+"'")
+		}
+		return nil
+	}
+	if res.ActiveBookingID != bookingID {
+		return newError(ERR_CONFLICT, "Vessel "+res.VesselID+" follows booking "+res.ActiveBookingID+", not "+bookingID)
+	}
+	return checkStatusTransition(res.BerthBookingStatus, to)
+}
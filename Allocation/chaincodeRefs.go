@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var ChaincodeRefsKey = "_ChaincodeRefs" //key of the Vessel and Berth chaincodes the workflows call
+
+type ChaincodeRefs struct { // The chaincodes trusted for vessel and booking data
+	VesselChaincode string `json:"vesselChaincode"`
+	BerthChaincode  string `json:"berthChaincode"`
+	LastModifiedBy  string `json:"lastModifiedBy"` // signer of the latest change, empty when set at deployment
+	LastModifiedAt  string `json:"lastModifiedAt"`
+}
+
+// ============================================================================================================================
+// parseChaincodeRefs - build the chaincode references from the Vessel and Berth chaincode arguments
+// ============================================================================================================================
+func parseChaincodeRefs(args []string) (ChaincodeRefs, error) {
+	refs := ChaincodeRefs{VesselChaincode: strings.TrimSpace(args[0]), BerthChaincode: strings.TrimSpace(args[1])}
+	if refs.VesselChaincode == "" {
+		return refs, fieldError("vesselChaincode", "Vessel chaincode must not be empty")
+	}
+	if refs.BerthChaincode == "" {
+		return refs, fieldError("berthChaincode", "Berth chaincode must not be empty")
+	}
+	return refs, nil
+}
+
+// ============================================================================================================================
+// putChaincodeRefs - store the chaincode references
+// ============================================================================================================================
+func putChaincodeRefs(stub shim.ChaincodeStubInterface, refs ChaincodeRefs) error {
+	refsAsBytes, _ := json.Marshal(refs)
+	return stub.PutState(ChaincodeRefsKey, refsAsBytes)
+}
+
+// ============================================================================================================================
+// chaincodeRefs - the Vessel and Berth chaincodes every workflow calls, never taken from the caller
+// ============================================================================================================================
+func chaincodeRefs(stub shim.ChaincodeStubInterface) (string, string, error) {
+	refsAsBytes, err := stub.GetState(ChaincodeRefsKey)
+	if err != nil {
+		return "", "", errors.New("Failed to get the chaincode references")
+	}
+	refs := ChaincodeRefs{}
+	json.Unmarshal(refsAsBytes, &refs)
+	if refs.VesselChaincode == "" || refs.BerthChaincode == "" {
+		return "", "", newError(ERR_CONFLICT, "The Vessel and Berth chaincodes are not configured, call set_chaincode_references")
+	}
+	return refs.VesselChaincode, refs.BerthChaincode, nil
+}
+
+// ============================================================================================================================
+// set_chaincode_references - point the workflows at other Vessel and Berth chaincodes
+// ============================================================================================================================
+func (t *ManageAllocations) set_chaincode_references(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2 args: VesselChaincode, BerthChainCode")
+	}
+	fmt.Println("start set_chaincode_references")
+	refs, err := parseChaincodeRefs(args)
+	if err != nil {
+		return nil, err
+	}
+	actor, err := getActor(stub)
+	if err != nil {
+		return nil, err
+	}
+	refs.LastModifiedBy = actor.ID()
+	refs.LastModifiedAt = actor.Time
+	err = putChaincodeRefs(stub, refs)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("end set_chaincode_references")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// get_chaincode_references - get the Vessel and Berth chaincodes the workflows call
+// ============================================================================================================================
+func (t *ManageAllocations) get_chaincode_references(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	refsAsBytes, err := stub.GetState(ChaincodeRefsKey)
+	if err != nil {
+		return nil, errors.New("Failed to get the chaincode references")
+	}
+	if refsAsBytes == nil {
+		return nil, newError(ERR_NOT_FOUND, "The Vessel and Berth chaincodes are not configured")
+	}
+	return refsAsBytes, nil
+}
@@ -24,6 +24,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
+
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"github.com/hyperledger/fabric/core/util"
 )
@@ -32,6 +36,7 @@ type ManageAllocations struct {
 }
 
 type Berth struct{							// Attributes of a Berth 				
+	BookingID string `json:"bookingID"`
 	VesselID string `json:"vesselID"`
 	VesselName string `json:"vesselName"`					
 	VesselType string `json:"vesselType"`
@@ -51,6 +56,24 @@ type Berth struct{							// Attributes of a Berth
 	PortOfRegisteration string `json:"portOfRegisteration"`
 	OwnerName string `json:"ownerName"`
 	OwnerPhoneNumber string `json:"ownerPhoneNumber"`
+	PreferredBerth string `json:"preferredBerth"`
+	AllocatedBerth string `json:"allocatedBerth"`
+	RequestedETB string `json:"requestedETB"`
+	RequestedETD string `json:"requestedETD"`
+	AllocatedETB string `json:"allocatedETB"`
+	AllocatedETD string `json:"allocatedETD"`
+	TODecision string `json:"toDecision"`				// Confirmed or Declined by the terminal operator, TOID signed it
+	TODecisionAt string `json:"toDecisionAt"`
+	TORemarks string `json:"toRemarks"`
+	PADecision string `json:"paDecision"`				// Approved or Rejected by the port authority, ApproverID signed it
+	PADecisionAt string `json:"paDecisionAt"`
+	PARemarks string `json:"paRemarks"`
+	ReasonCode string `json:"reasonCode"`				// why the booking was rejected or cancelled, from the reason code catalogue
+	ReasonRemarks string `json:"reasonRemarks"`
+	CreatedBy string `json:"createdBy"`				// signer of the creating transaction, MSP ID / certificate subject
+	CreatedAt string `json:"createdAt"`				// transaction timestamp, RFC3339
+	LastModifiedBy string `json:"lastModifiedBy"`		// signer of the latest change
+	LastModifiedAt string `json:"lastModifiedAt"`
 	
 }
 
@@ -72,9 +95,30 @@ type Vessel struct{							// Attributes of a Vessel
 	OwnerCountry string `json:"ownerCountry"`
 	VesselClass string `json:"vesselClass"`
 	BerthBookingStatus string `json:"berthBookingStatus"`
+	ActiveBookingID string `json:"activeBookingID"`		// booking whose status the vessel carries, empty when none holds it
+	LOA float64 `json:"loa"`
+	Beam float64 `json:"beam"`
+	Draft float64 `json:"draft"`
+	GT float64 `json:"gt"`
+	DWT float64 `json:"dwt"`
+	CreatedBy string `json:"createdBy"`				// signer of the creating transaction, MSP ID / certificate subject
+	CreatedAt string `json:"createdAt"`				// transaction timestamp, RFC3339
+	LastModifiedBy string `json:"lastModifiedBy"`		// signer of the latest change
+	LastModifiedAt string `json:"lastModifiedAt"`
 	
 }
 
+type BerthMaster struct{						// Attributes of a physical berth
+	BerthCode string `json:"berthCode"`
+	Terminal string `json:"terminal"`
+	QuayLength float64 `json:"quayLength"`
+	MaxDraft float64 `json:"maxDraft"`
+	MaxLOA float64 `json:"maxLOA"`
+	BollardCapacity float64 `json:"bollardCapacity"`
+	AllowedVesselTypes []string `json:"allowedVesselTypes"`
+	Active bool `json:"active"`
+}
+
 // ============================================================================================================================
 // Main - start the chaincode for Allocation management
 // ============================================================================================================================
@@ -86,23 +130,26 @@ func main() {
 }
 
 // ============================================================================================================================
-// Init - reset all the things
+// Init - entry point, the answer or failure is wrapped in the response envelope
 // ============================================================================================================================
 func (t *ManageAllocations) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	var msg string
+	return respond(t.initChaincode(stub, function, args))
+}
+// ============================================================================================================================
+// initChaincode - reset all the things and record the Vessel and Berth chaincodes the workflows call
+// ============================================================================================================================
+func (t *ManageAllocations) initChaincode(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	var err error
-	if len(args) != 1 {
-		errMsg := "{ \"message\" : \"Incorrect number of arguments. Expecting ' ' as an argument\", \"code\" : \"503\"}"
-		err = stub.SetEvent("errEvent", []byte(errMsg))
-		if err != nil {
-			return nil, err
-		}
-		return nil, nil
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2 args: VesselChaincode, BerthChainCode")
 	}
 	// Initialize the chaincode
-	msg = args[0]
+	refs, err := parseChaincodeRefs(args)
+	if err != nil {
+		return nil, err
+	}
 	// Write the state to the ledger
-	err = stub.PutState("abc", []byte(msg)) //making a test var "abc", I find it handy to read/write to it right away to test the network
+	err = putChaincodeRefs(stub, refs)
 	if err != nil {
 		return nil, err
 	}
@@ -113,8 +160,9 @@ func (t *ManageAllocations) Init(stub shim.ChaincodeStubInterface, function stri
 		return nil, err
 	}
 
-	tosend := "{ \"message\" : \"ManageAllocations chaincode is deployed successfully.\", \"code\" : \"200\"}"
-	err = stub.SetEvent("evtsender", []byte(tosend))
+	deployedAsBytes, _ := json.Marshal(map[string]string{"message": "ManageAllocations chaincode is deployed successfully."})
+	tosend, _ := respond(deployedAsBytes, nil) //same envelope as every other answer
+	err = stub.SetEvent("evtsender", tosend)
 	if err != nil {
 		return nil, err
 	}
@@ -130,391 +178,706 @@ func (t *ManageAllocations) Run(stub shim.ChaincodeStubInterface, function strin
 }
 
 // ============================================================================================================================
-// Invoke - Our entry Dealint for Invocations
+// Invoke - entry point, the answer or failure is wrapped in the response envelope
 // ============================================================================================================================
 func (t *ManageAllocations) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	return respond(t.invokeFunction(stub, function, args))
+}
+// ============================================================================================================================
+// invokeFunction - run an invocation, every one including the init reset carries a request ID (see invokeOnce)
+// ============================================================================================================================
+func (t *ManageAllocations) invokeFunction(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	fmt.Println("invoke is running " + function)
+	err := authorize(stub, function)
+	if err != nil {
+		return nil, err
+	}
 
+	return t.invokeOnce(stub, function, args)
+}
+
+// ============================================================================================================================
+// runInvocation - run an invocation once its request ID is taken off the arguments
+// ============================================================================================================================
+func (t *ManageAllocations) runInvocation(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	// Handle different functions
 	if function == "init" { // Initialize the chaincode state, used as reset
-		return t.Init(stub, "init", args)
+		return t.initChaincode(stub, "init", args)
+	} else if function == "set_chaincode_references" { // Point the workflows at other Vessel and Berth chaincodes
+		return t.set_chaincode_references(stub, args)
 	} else if function == "cancel_booking" { // Secondary Fire when Longbox account is updated
 		return t.cancel_booking(stub, args)
 	} else if function == "berth_allocation" { // Create a new Allocation
 		return t.berth_allocation(stub, args)
+	} else if function == "confirm_allocation" { // Terminal operator accepts the allocation
+		return t.confirm_allocation(stub, args)
+	} else if function == "decline_allocation" { // Terminal operator refuses the allocation
+		return t.decline_allocation(stub, args)
 	} else if function == "approve_allocation" { // Secondary Fire when Longbox account is updated
 		return t.approve_allocation(stub, args)
 	} else if function == "reject_allocation" { // Secondary Fire when Longbox account is updated
 		return t.reject_allocation(stub, args)
+	} else if function == "auto_allocate" { // Pick the best free berth for a booking
+		return t.auto_allocate(stub, args)
+	} else if function == "berth_vessel" { // Vessel is alongside its approved berth
+		return t.berth_vessel(stub, args)
+	} else if function == "depart_vessel" { // Vessel has left its berth
+		return t.depart_vessel(stub, args)
 	}
 	fmt.Println("invoke did not find func: " + function)
-	errMsg := "{ \"message\" : \"Received unknown function invocation\", \"code\" : \"503\"}"
-	err := stub.SetEvent("errEvent", []byte(errMsg))
-	if err != nil {
-		return nil, err
-	}
-	return nil, nil
+	return nil, newError(ERR_INVALID_ARGUMENT, "Received unknown function invocation")
 }
 
 // ============================================================================================================================
-// Query - Our entry Dealint for Queries
+// Query - entry point, the answer or failure is wrapped in the response envelope
 // ============================================================================================================================
-
 func (t *ManageAllocations) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	fmt.Println("query is running " + function)
+	return respond(t.queryFunction(stub, function, args))
+}
+// ============================================================================================================================
+// queryFunction - run a query
+// ============================================================================================================================
 
-	// Handle different functions
-	/*if function == "nil" {
-		return t.nil(stub, args)
-	}*/
-	fmt.Println("Allocation does not support query functions.")
-	errMsg := "{ \"message\" : \"Allocation does not support query functions.\", \"code\" : \"503\"}"
-	err := stub.SetEvent("errEvent", []byte(errMsg))
+func (t *ManageAllocations) queryFunction(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	fmt.Println("query is running " + function)
+	err := authorize(stub, function)
 	if err != nil {
 		return nil, err
 	}
-	return nil, nil
+
+	// Handle different functions
+	if function == "plan_allocation" { // What-if evaluation of proposed berth assignments
+		return t.plan_allocation(stub, args)
+	} else if function == "getAllocation_byID" { // Read one allocation record
+		return t.getAllocation_byID(stub, args)
+	} else if function == "getAllocations_byBooking" { // Read every allocation of a booking
+		return t.getAllocations_byBooking(stub, args)
+	} else if function == "getAllocations_byVessel" { // Read every allocation of a vessel
+		return t.getAllocations_byVessel(stub, args)
+	} else if function == "getAllocations_byBerth" { // Read every allocation of a berth
+		return t.getAllocations_byBerth(stub, args)
+	} else if function == "getAllocations_byStatus" { // Read every allocation in a status
+		return t.getAllocations_byStatus(stub, args)
+	} else if function == "getAllocations_byDate" { // Read every allocation touching a day
+		return t.getAllocations_byDate(stub, args)
+	} else if function == "getAllocations_pendingApproval" { // Read the allocations awaiting the port authority
+		return t.getAllocations_pendingApproval(stub, args)
+	} else if function == "getAllocations_byApprover" { // Read every allocation decided by an approver
+		return t.getAllocations_byApprover(stub, args)
+	} else if function == "getAllocations_byBerthAndDate" { // Read the allocations of a berth on a day
+		return t.getAllocations_byBerthAndDate(stub, args)
+	} else if function == "get_vesselView" { // Read a vessel with its bookings and allocations
+		return t.get_vesselView(stub, args)
+	} else if function == "get_chaincode_references" { // Read the Vessel and Berth chaincodes in use
+		return t.get_chaincode_references(stub, args)
+	}
+	fmt.Println("query did not find func: " + function)
+	return nil, newError(ERR_INVALID_ARGUMENT, "Received unknown function query")
 }
 
 
 // ============================================================================================================================
-// Start Allocation - create a new Allocation, store into chaincode state
+// fetchBooking - get a berth booking from the Berth chaincode
+// ============================================================================================================================
+func fetchBooking(stub shim.ChaincodeStubInterface, BerthChainCode string, BookingID string) (Berth, error) {
+	BerthData := Berth{}
+	f := "getBerth_byBookingID"
+	queryArgs := util.ToChaincodeArgs(f, BookingID)
+	berthAsBytes, err := unwrapResponse(stub.QueryChaincode(BerthChainCode, queryArgs))
+	if err != nil && !hasCode(err, ERR_NOT_FOUND) {
+		errStr := fmt.Sprintf("Failed to query chaincode. Got error: %s", err.Error())
+		fmt.Printf(errStr)
+		return BerthData, remoteError(errStr, err)
+	}
+	json.Unmarshal(berthAsBytes, &BerthData)
+	fmt.Println(BerthData)
+	if BerthData.BookingID != BookingID {
+		return BerthData, newError(ERR_NOT_FOUND, "Berth booking " + BookingID + " not found in the Berth chaincode")
+	}
+	fmt.Println("Berth found with BookingID : " + BookingID)
+	return BerthData, nil
+}
+
+// ============================================================================================================================
+// fetchVessel - get a vessel from the Vessel chaincode
+// ============================================================================================================================
+func fetchVessel(stub shim.ChaincodeStubInterface, VesselChaincode string, VesselID string) (Vessel, error) {
+	VesselData := Vessel{}
+	f := "getVessel_byID"
+	queryArgs := util.ToChaincodeArgs(f, VesselID)
+	vesselAsBytes, err := unwrapResponse(stub.QueryChaincode(VesselChaincode, queryArgs))
+	if err != nil && !hasCode(err, ERR_NOT_FOUND) {
+		errStr := fmt.Sprintf("Failed to query chaincode. Got error: %s", err.Error())
+		fmt.Printf(errStr)
+		return VesselData, remoteError(errStr, err)
+	}
+	json.Unmarshal(vesselAsBytes, &VesselData)
+	fmt.Println(VesselData)
+	if VesselData.VesselID != VesselID {
+		return VesselData, newError(ERR_NOT_FOUND, "Vessel record " + VesselID + " not found in the Vessel chaincode")
+	}
+	fmt.Println("Vessel found with VesselID : " + VesselID)
+	return VesselData, nil
+}
+
+// ============================================================================================================================
+// Start Allocation - move a booking to 'In Progress'
 // ============================================================================================================================
 func (t *ManageAllocations) berth_allocation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var err error
-	if len(args) != 3 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 3 args")
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting BookingID")
 	}
-	fmt.Println("start start_allocation")
+	fmt.Println("start berth_allocation")
 
 	// Alloting Params
-	VesselChaincode := args[0]
-	BerthChainCode := args[1]
-	VesselID := args[2]
-
+	BookingID := args[0]
 
 	//-----------------------------------------------------------------------------
 
-	// Fetch Vessel details from Blockchain
-	f1 := "getVessel_byID"
-	queryArgs1 := util.ToChaincodeArgs(f1, VesselID)
-	vesselAsBytes, err := stub.QueryChaincode(VesselChaincode, queryArgs1)
+	// Vessel and Berth chaincodes configured by the admin
+	VesselChaincode, BerthChainCode, err := chaincodeRefs(stub)
 	if err != nil {
-		errStr := fmt.Sprintf("Failed to query chaincode. Got error: %s", err.Error())
-		fmt.Printf(errStr)
-		return nil, errors.New(errStr)
+		return nil, err
 	}
-	VesselData := Vessel{}
-	json.Unmarshal(vesselAsBytes, &VesselData)
-	fmt.Println(VesselData)
-	if VesselData.VesselID == VesselID {
-		fmt.Println("Vessel found with VesselID : " + VesselID)
-	} else {
-		return nil, errors.New("Vessel ID not found")
+
+	// Fetch Berth booking details from Blockchain
+	BerthData, err := fetchBooking(stub, BerthChainCode, BookingID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch Vessel details from Blockchain
+	VesselData, err := fetchVessel(stub, VesselChaincode, BerthData.VesselID)
+	if err != nil {
+		return nil, err
 	}
 
+	// Make sure the vessel physically fits the berth it is asking for
+	TargetBerth := BerthData.AllocatedBerth
+	if TargetBerth == "" {
+		TargetBerth = BerthData.PreferredBerth
+	}
+	if TargetBerth != "" {
+		BerthMasterData, err := fetchBerthMaster(stub, BerthChainCode, TargetBerth)
+		if err != nil {
+			return nil, err
+		}
+		reasons := checkVesselFitsBerth(VesselData, BerthMasterData)
+		if len(reasons) > 0 {
+			return nil, newError(ERR_CONFLICT, "Vessel " + VesselData.VesselID + " does not fit berth " + TargetBerth + ": " + strings.Join(reasons, "; "))
+		}
+	}
 
-	// Fetch Berth details from Blockchain
-	f2 := "getBerth_byVesselID"
-	queryArgs2 := util.ToChaincodeArgs(f2, VesselID)
-	berthAsBytes, err := stub.QueryChaincode(BerthChainCode, queryArgs2)
+	// Make sure the caller may move this booking to "In Progress"
+	caller, err := getCaller(stub)
 	if err != nil {
-		errStr := fmt.Sprintf("Failed to query chaincode. Got error: %s", err.Error())
-		fmt.Printf(errStr)
-		return nil, errors.New(errStr)
+		return nil, err
 	}
-	BerthData := Berth{}
-	json.Unmarshal(berthAsBytes, &BerthData)
-	fmt.Println(BerthData)
-	if BerthData.VesselID == VesselID {
-		fmt.Println("Berth found with VesselID : " + VesselID)
-	} else {
-		return nil, errors.New("Vessel ID not found")
+	err = checkStatusPermission(caller, BerthData, STATUS_IN_PROGRESS)
+	if err != nil {
+		return nil, err
 	}
 
-	// Update allocation status to "Allocation in progress"
-	f3 := "update_vessel_allocationStatus"
-	invokeArgs1 := util.ToChaincodeArgs(f3, VesselID, "In Progress")
-	result1, err := stub.InvokeChaincode(VesselChaincode, invokeArgs1)
+	// Make sure the booking and its vessel may move to "In Progress"
+	err = checkBookingStatusChange(BerthData, VesselData, STATUS_IN_PROGRESS)
 	if err != nil {
-		errStr := fmt.Sprintf("Failed to update Transaction status from 'Vessel' chaincode. Got error: %s", err.Error())
-		fmt.Printf(errStr)
-		return nil, errors.New(errStr)
+		return nil, err
 	}
-	fmt.Print("Transaction hash returned: ")
-	fmt.Println(result1)
-	fmt.Println("Successfully updated allocation status to 'In progress'")
 
-	// Update allocation status to "Allocation in progress"
-	f4 := "update_berth_allocationStatus"
-	invokeArgs2 := util.ToChaincodeArgs(f4, VesselID, "In Progress", " ")
-	result2, err := stub.InvokeChaincode(BerthChainCode, invokeArgs2)
+	// Update the booking and its vessel to "In Progress"
+	err = setBookingStatus(stub, VesselChaincode, BerthChainCode, BerthData, VesselData, STATUS_IN_PROGRESS, "", "Berth allocation started", "")
 	if err != nil {
-		errStr := fmt.Sprintf("Failed to update Transaction status from 'Berth' chaincode. Got error: %s", err.Error())
-		fmt.Printf(errStr)
-		return nil, errors.New(errStr)
+		return nil, err
+	}
+
+	// Write the berth asked for back to the booking
+	if BerthData.AllocatedBerth == "" && TargetBerth != "" {
+		f5 := "update_berth_allocation"
+		invokeArgs3 := util.ToChaincodeArgs(f5, BookingID, TargetBerth, BerthData.RequestedETB, BerthData.RequestedETD)
+		_, err = unwrapResponse(stub.InvokeChaincode(BerthChainCode, invokeArgs3))
+		if err != nil {
+			errStr := fmt.Sprintf("Failed to update allocated berth from 'Berth' chaincode. Got error: %s", err.Error())
+			fmt.Printf(errStr)
+			return nil, remoteError(errStr, err)
+		}
+		BerthData.AllocatedBerth = TargetBerth
+		BerthData.AllocatedETB = BerthData.RequestedETB
+		BerthData.AllocatedETD = BerthData.RequestedETD
+		fmt.Println("Allocated berth " + TargetBerth + " to booking " + BookingID)
 	}
-	fmt.Print("Transaction hash returned: ")
-	fmt.Println(result2)
-	fmt.Println("Successfully updated allocation status to 'In progress'")
 
-	fmt.Println("end start_allocation")
+	// Record the step on the booking's allocation
+	BerthData.BerthBookingStatus = STATUS_IN_PROGRESS
+	_, err = recordAllocation(stub, BerthData, "berth_allocation", "Berth allocation started")
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("end berth_allocation")
 	return nil, nil
 }
 
-
 // ============================================================================================================================
-// Cancel Booking - create a new Allocation, store into chaincode state
+// Cancel Booking - cancel a booking on both the vessel and the berth booking, with a reason code and remarks
 // ============================================================================================================================
 func (t *ManageAllocations) cancel_booking(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var err error
 	if len(args) != 3 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 3 args")
+		return nil, errors.New("Incorrect number of arguments. Expecting 3 args: BookingID, reason code, remarks")
 	}
-	fmt.Println("start start_allocation")
+	fmt.Println("start cancel_booking")
 
 	// Alloting Params
-	VesselChaincode := args[0]
-	BerthChainCode := args[1]
-	VesselID := args[2]
-
+	BookingID := args[0]
+	Reason := args[1]
+	Remarks := args[2]
 
 	//-----------------------------------------------------------------------------
 
+	// Vessel and Berth chaincodes configured by the admin
+	VesselChaincode, BerthChainCode, err := chaincodeRefs(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch Berth booking details from Blockchain
+	BerthData, err := fetchBooking(stub, BerthChainCode, BookingID)
+	if err != nil {
+		return nil, err
+	}
+
 	// Fetch Vessel details from Blockchain
-	f1 := "getVessel_byID"
-	queryArgs1 := util.ToChaincodeArgs(f1, VesselID)
-	vesselAsBytes, err := stub.QueryChaincode(VesselChaincode, queryArgs1)
+	VesselData, err := fetchVessel(stub, VesselChaincode, BerthData.VesselID)
 	if err != nil {
-		errStr := fmt.Sprintf("Failed to query chaincode. Got error: %s", err.Error())
-		fmt.Printf(errStr)
-		return nil, errors.New(errStr)
+		return nil, err
 	}
-	VesselData := Vessel{}
-	json.Unmarshal(vesselAsBytes, &VesselData)
-	fmt.Println(VesselData)
-	if VesselData.VesselID == VesselID {
-		fmt.Println("Vessel found with VesselID : " + VesselID)
-	} else {
-		return nil, errors.New("Vessel ID not found")
+
+	// Make sure the caller may move this booking to "Cancelled"
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = checkStatusPermission(caller, BerthData, STATUS_CANCELLED)
+	if err != nil {
+		return nil, err
 	}
 
+	// Make sure the booking and its vessel may move to "Cancelled"
+	err = checkBookingStatusChange(BerthData, VesselData, STATUS_CANCELLED)
+	if err != nil {
+		return nil, err
+	}
 
-	// Fetch Berth details from Blockchain
-	f2 := "getBerth_byVesselID"
-	queryArgs2 := util.ToChaincodeArgs(f2, VesselID)
-	berthAsBytes, err := stub.QueryChaincode(BerthChainCode, queryArgs2)
+	// Make sure the reason may be given for "Cancelled"
+	ReasonData, err := fetchReasonCode(stub, BerthChainCode, Reason, Remarks, STATUS_CANCELLED)
 	if err != nil {
-		errStr := fmt.Sprintf("Failed to query chaincode. Got error: %s", err.Error())
-		fmt.Printf(errStr)
-		return nil, errors.New(errStr)
+		return nil, err
 	}
-	BerthData := Berth{}
-	json.Unmarshal(berthAsBytes, &BerthData)
-	fmt.Println(BerthData)
-	if BerthData.VesselID == VesselID {
-		fmt.Println("Berth found with VesselID : " + VesselID)
-	} else {
-		return nil, errors.New("Vessel ID not found")
+	actor, err := getActor(stub)
+	if err != nil {
+		return nil, err
 	}
 
-	// Update allocation status to "Allocation in progress"
-	f3 := "update_vessel_allocationStatus"
-	invokeArgs1 := util.ToChaincodeArgs(f3, VesselID, "Cancelled")
-	result1, err := stub.InvokeChaincode(VesselChaincode, invokeArgs1)
+	// Update the booking and its vessel to "Cancelled"
+	err = setBookingStatus(stub, VesselChaincode, BerthChainCode, BerthData, VesselData, STATUS_CANCELLED, "", Remarks, ReasonData.Code)
 	if err != nil {
-		errStr := fmt.Sprintf("Failed to update Transaction status from 'Vessel' chaincode. Got error: %s", err.Error())
-		fmt.Printf(errStr)
-		return nil, errors.New(errStr)
+		return nil, err
+	}
+
+	// Record the step on the booking's allocation, if it ever had one
+	if BerthData.BerthBookingStatus != STATUS_NEW {
+		BerthData.BerthBookingStatus = STATUS_CANCELLED
+		_, err = recordAllocation(stub, BerthData, "cancel_booking", Remarks)
+		if err != nil {
+			return nil, err
+		}
 	}
-	fmt.Print("Transaction hash returned: ")
-	fmt.Println(result1)
-	fmt.Println("Successfully updated allocation status to 'In progress'")
 
-	// Update allocation status to "Allocation in progress"
-	f4 := "update_berth_allocationStatus"
-	invokeArgs2 := util.ToChaincodeArgs(f4, VesselID, "Cancelled", " ")
-	result2, err := stub.InvokeChaincode(BerthChainCode, invokeArgs2)
+	err = emitStatusEvent(stub, BerthData, STATUS_CANCELLED, ReasonData, Remarks, actor)
 	if err != nil {
-		errStr := fmt.Sprintf("Failed to update Transaction status from 'Berth' chaincode. Got error: %s", err.Error())
-		fmt.Printf(errStr)
-		return nil, errors.New(errStr)
+		return nil, err
 	}
-	fmt.Print("Transaction hash returned: ")
-	fmt.Println(result2)
-	fmt.Println("Successfully updated allocation status to 'In progress'")
 
-	fmt.Println("end start_allocation")
+	fmt.Println("end cancel_booking")
 	return nil, nil
 }
 
 // ============================================================================================================================
-// Start Allocation - create a new Allocation, store into chaincode state
+// Approve Allocation - approve a booking confirmed by its terminal operator once its berth is known to be free
 // ============================================================================================================================
 func (t *ManageAllocations) approve_allocation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var err error
-	if len(args) != 4 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 4 args")
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2 args: BookingID, ApproverID")
 	}
 	fmt.Println("start approve_allocation")
 
 	// Alloting Params
-	VesselChaincode := args[0]
-	BerthChainCode := args[1]
-	VesselID := args[2]
-	ApproverID := args[3]
+	BookingID := args[0]
+	ApproverID := args[1]
 
 	//-----------------------------------------------------------------------------
 
-	// Fetch Vessel details from Blockchain
-	f1 := "getVessel_byID"
-	queryArgs1 := util.ToChaincodeArgs(f1, VesselID)
-	vesselAsBytes, err := stub.QueryChaincode(VesselChaincode, queryArgs1)
+	// Vessel and Berth chaincodes configured by the admin
+	VesselChaincode, BerthChainCode, err := chaincodeRefs(stub)
 	if err != nil {
-		errStr := fmt.Sprintf("Failed to query chaincode. Got error: %s", err.Error())
-		fmt.Printf(errStr)
-		return nil, errors.New(errStr)
+		return nil, err
 	}
-	VesselData := Vessel{}
-	json.Unmarshal(vesselAsBytes, &VesselData)
-	fmt.Println(VesselData)
-	if VesselData.VesselID == VesselID {
-		fmt.Println("Vessel found with VesselID : " + VesselID)
-	} else {
-		return nil, errors.New("Vessel ID not found")
+
+	// Fetch Berth booking details from Blockchain
+	BerthData, err := fetchBooking(stub, BerthChainCode, BookingID)
+	if err != nil {
+		return nil, err
 	}
 
+	// Fetch Vessel details from Blockchain
+	VesselData, err := fetchVessel(stub, VesselChaincode, BerthData.VesselID)
+	if err != nil {
+		return nil, err
+	}
 
-	// Fetch Berth details from Blockchain
-	f2 := "getBerth_byVesselID"
-	queryArgs2 := util.ToChaincodeArgs(f2, VesselID)
-	berthAsBytes, err := stub.QueryChaincode(BerthChainCode, queryArgs2)
+	// Make sure the caller may move this booking to "Approved"
+	caller, err := getCaller(stub)
 	if err != nil {
-		errStr := fmt.Sprintf("Failed to query chaincode. Got error: %s", err.Error())
-		fmt.Printf(errStr)
-		return nil, errors.New(errStr)
+		return nil, err
 	}
-	BerthData := Berth{}
-	json.Unmarshal(berthAsBytes, &BerthData)
-	fmt.Println(BerthData)
-	if BerthData.VesselID == VesselID {
-		fmt.Println("Berth found with VesselID : " + VesselID)
-	} else {
-		return nil, errors.New("Vessel ID not found")
+	actor, err := checkApprover(stub, ApproverID)
+	if err != nil {
+		return nil, err
+	}
+	err = checkStatusPermission(caller, BerthData, STATUS_APPROVED)
+	if err != nil {
+		return nil, err
 	}
 
-	// Update allocation status to "Allocation in progress"
-	f3 := "update_vessel_allocationStatus"
-	invokeArgs1 := util.ToChaincodeArgs(f3, VesselID, "Approved")
-	result1, err := stub.InvokeChaincode(VesselChaincode, invokeArgs1)
+	// Make sure the booking and its vessel may move to "Approved"
+	err = checkBookingStatusChange(BerthData, VesselData, STATUS_APPROVED)
 	if err != nil {
-		errStr := fmt.Sprintf("Failed to update Transaction status from 'Vessel' chaincode. Got error: %s", err.Error())
-		fmt.Printf(errStr)
-		return nil, errors.New(errStr)
+		return nil, err
 	}
-	fmt.Print("Transaction hash returned: ")
-	fmt.Println(result1)
-	fmt.Println("Successfully updated allocation status to 'In progress'")
 
-	// Update allocation status to "Allocation in progress"
-	f4 := "update_berth_allocationStatus"
-	invokeArgs2 := util.ToChaincodeArgs(f4, VesselID, "Approved", ApproverID)
-	result2, err := stub.InvokeChaincode(BerthChainCode, invokeArgs2)
+	// Make sure nobody else is approved on the same berth for an overlapping window
+	err = checkBerthConflicts(stub, BerthChainCode, BerthData)
 	if err != nil {
-		errStr := fmt.Sprintf("Failed to update Transaction status from 'Berth' chaincode. Got error: %s", err.Error())
-		fmt.Printf(errStr)
-		return nil, errors.New(errStr)
+		return nil, err
+	}
+
+	// Update the booking and its vessel to "Approved"
+	err = setBookingStatus(stub, VesselChaincode, BerthChainCode, BerthData, VesselData, STATUS_APPROVED, actor.ID(), "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Record the step on the booking's allocation
+	BerthData.BerthBookingStatus = STATUS_APPROVED
+	BerthData.ApproverID = actor.ID()
+	_, err = recordAllocation(stub, BerthData, "approve_allocation", "")
+	if err != nil {
+		return nil, err
 	}
-	fmt.Print("Transaction hash returned: ")
-	fmt.Println(result2)
-	fmt.Println("Successfully updated allocation status to 'In progress'")
 
 	fmt.Println("end approve_allocation")
 	return nil, nil
 }
 
 // ============================================================================================================================
-// Start Allocation - create a new Allocation, store into chaincode state
+// Reject Allocation - reject a booking with a reason code and remarks
 // ============================================================================================================================
 func (t *ManageAllocations) reject_allocation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var err error
 	if len(args) != 4 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 4 args")
+		return nil, errors.New("Incorrect number of arguments. Expecting 4 args: BookingID, ApproverID, reason code, remarks")
 	}
-	fmt.Println("start approve_allocation")
+	fmt.Println("start reject_allocation")
 
 	// Alloting Params
-	VesselChaincode := args[0]
-	BerthChainCode := args[1]
-	VesselID := args[2]
-	ApproverID := args[3]
+	BookingID := args[0]
+	ApproverID := args[1]
+	Reason := args[2]
+	Remarks := args[3]
+
+	//-----------------------------------------------------------------------------
+
+	// Vessel and Berth chaincodes configured by the admin
+	VesselChaincode, BerthChainCode, err := chaincodeRefs(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch Berth booking details from Blockchain
+	BerthData, err := fetchBooking(stub, BerthChainCode, BookingID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch Vessel details from Blockchain
+	VesselData, err := fetchVessel(stub, VesselChaincode, BerthData.VesselID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure the caller may move this booking to "Rejected"
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	actor, err := checkApprover(stub, ApproverID)
+	if err != nil {
+		return nil, err
+	}
+	err = checkStatusPermission(caller, BerthData, STATUS_REJECTED)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure the booking and its vessel may move to "Rejected"
+	err = checkBookingStatusChange(BerthData, VesselData, STATUS_REJECTED)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure the reason may be given for "Rejected"
+	ReasonData, err := fetchReasonCode(stub, BerthChainCode, Reason, Remarks, STATUS_REJECTED)
+	if err != nil {
+		return nil, err
+	}
+
+	// Update the booking and its vessel to "Rejected"
+	err = setBookingStatus(stub, VesselChaincode, BerthChainCode, BerthData, VesselData, STATUS_REJECTED, actor.ID(), Remarks, ReasonData.Code)
+	if err != nil {
+		return nil, err
+	}
+
+	// Record the step on the booking's allocation
+	BerthData.BerthBookingStatus = STATUS_REJECTED
+	BerthData.ApproverID = actor.ID()
+	_, err = recordAllocation(stub, BerthData, "reject_allocation", Remarks)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitStatusEvent(stub, BerthData, STATUS_REJECTED, ReasonData, Remarks, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("end reject_allocation")
+	return nil, nil
+}
 
+// ============================================================================================================================
+// Berth Vessel - record that an approved vessel is alongside its berth
+// ============================================================================================================================
+func (t *ManageAllocations) berth_vessel(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting BookingID")
+	}
+	fmt.Println("start berth_vessel")
+
+	// Alloting Params
+	BookingID := args[0]
 
 	//-----------------------------------------------------------------------------
 
+	// Vessel and Berth chaincodes configured by the admin
+	VesselChaincode, BerthChainCode, err := chaincodeRefs(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch Berth booking details from Blockchain
+	BerthData, err := fetchBooking(stub, BerthChainCode, BookingID)
+	if err != nil {
+		return nil, err
+	}
+
 	// Fetch Vessel details from Blockchain
-	f1 := "getVessel_byID"
-	queryArgs1 := util.ToChaincodeArgs(f1, VesselID)
-	vesselAsBytes, err := stub.QueryChaincode(VesselChaincode, queryArgs1)
+	VesselData, err := fetchVessel(stub, VesselChaincode, BerthData.VesselID)
 	if err != nil {
-		errStr := fmt.Sprintf("Failed to query chaincode. Got error: %s", err.Error())
-		fmt.Printf(errStr)
-		return nil, errors.New(errStr)
+		return nil, err
 	}
-	VesselData := Vessel{}
-	json.Unmarshal(vesselAsBytes, &VesselData)
-	fmt.Println(VesselData)
-	if VesselData.VesselID == VesselID {
-		fmt.Println("Vessel found with VesselID : " + VesselID)
-	} else {
-		return nil, errors.New("Vessel ID not found")
+
+	// Make sure the caller may move this booking to "Berthed"
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = checkStatusPermission(caller, BerthData, STATUS_BERTHED)
+	if err != nil {
+		return nil, err
 	}
 
+	// Make sure the booking and its vessel may move to "Berthed"
+	err = checkBookingStatusChange(BerthData, VesselData, STATUS_BERTHED)
+	if err != nil {
+		return nil, err
+	}
 
-	// Fetch Berth details from Blockchain
-	f2 := "getBerth_byVesselID"
-	queryArgs2 := util.ToChaincodeArgs(f2, VesselID)
-	berthAsBytes, err := stub.QueryChaincode(BerthChainCode, queryArgs2)
+	// Update the booking and its vessel to "Berthed"
+	err = setBookingStatus(stub, VesselChaincode, BerthChainCode, BerthData, VesselData, STATUS_BERTHED, "", "Vessel alongside", "")
 	if err != nil {
-		errStr := fmt.Sprintf("Failed to query chaincode. Got error: %s", err.Error())
-		fmt.Printf(errStr)
-		return nil, errors.New(errStr)
+		return nil, err
 	}
-	BerthData := Berth{}
-	json.Unmarshal(berthAsBytes, &BerthData)
-	fmt.Println(BerthData)
-	if BerthData.VesselID == VesselID {
-		fmt.Println("Berth found with VesselID : " + VesselID)
-	} else {
-		return nil, errors.New("Vessel ID not found")
+
+	// Record the step on the booking's allocation
+	BerthData.BerthBookingStatus = STATUS_BERTHED
+	_, err = recordAllocation(stub, BerthData, "berth_vessel", "Vessel alongside")
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("end berth_vessel")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Depart Vessel - record that a berthed vessel has left its berth
+// ============================================================================================================================
+func (t *ManageAllocations) depart_vessel(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting BookingID")
 	}
+	fmt.Println("start depart_vessel")
 
-	// Update allocation status to "Allocation in progress"
-	f3 := "update_vessel_allocationStatus"
-	invokeArgs1 := util.ToChaincodeArgs(f3, VesselID, "Rejected")
-	result1, err := stub.InvokeChaincode(VesselChaincode, invokeArgs1)
+	// Alloting Params
+	BookingID := args[0]
+
+	//-----------------------------------------------------------------------------
+
+	// Vessel and Berth chaincodes configured by the admin
+	VesselChaincode, BerthChainCode, err := chaincodeRefs(stub)
 	if err != nil {
-		errStr := fmt.Sprintf("Failed to update Transaction status from 'Vessel' chaincode. Got error: %s", err.Error())
-		fmt.Printf(errStr)
-		return nil, errors.New(errStr)
+		return nil, err
 	}
-	fmt.Print("Transaction hash returned: ")
-	fmt.Println(result1)
-	fmt.Println("Successfully updated allocation status to 'In progress'")
 
-	// Update allocation status to "Allocation in progress"
-	f4 := "update_berth_allocationStatus"
-	invokeArgs2 := util.ToChaincodeArgs(f4, VesselID, "Rejected", ApproverID)
-	result2, err := stub.InvokeChaincode(BerthChainCode, invokeArgs2)
+	// Fetch Berth booking details from Blockchain
+	BerthData, err := fetchBooking(stub, BerthChainCode, BookingID)
 	if err != nil {
-		errStr := fmt.Sprintf("Failed to update Transaction status from 'Berth' chaincode. Got error: %s", err.Error())
-		fmt.Printf(errStr)
-		return nil, errors.New(errStr)
+		return nil, err
 	}
-	fmt.Print("Transaction hash returned: ")
-	fmt.Println(result2)
-	fmt.Println("Successfully updated allocation status to 'In progress'")
 
-	fmt.Println("end approve_allocation")
+	// Fetch Vessel details from Blockchain
+	VesselData, err := fetchVessel(stub, VesselChaincode, BerthData.VesselID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure the caller may move this booking to "Departed"
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = checkStatusPermission(caller, BerthData, STATUS_DEPARTED)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure the booking and its vessel may move to "Departed"
+	err = checkBookingStatusChange(BerthData, VesselData, STATUS_DEPARTED)
+	if err != nil {
+		return nil, err
+	}
+
+	// Update the booking and its vessel to "Departed"
+	err = setBookingStatus(stub, VesselChaincode, BerthChainCode, BerthData, VesselData, STATUS_DEPARTED, "", "Vessel departed", "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Record the step on the booking's allocation
+	BerthData.BerthBookingStatus = STATUS_DEPARTED
+	_, err = recordAllocation(stub, BerthData, "depart_vessel", "Vessel departed")
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("end depart_vessel")
 	return nil, nil
 }
+
+// ============================================================================================================================
+// bookingWindow - the berthing window of a booking, the allocated window wins over the requested one
+// ============================================================================================================================
+func bookingWindow(booking Berth) (time.Time, time.Time, error) {
+	etb, etd := booking.AllocatedETB, booking.AllocatedETD
+	if etb == "" && etd == "" {
+		etb, etd = booking.RequestedETB, booking.RequestedETD
+	}
+	start, err := time.Parse(time.RFC3339, etb)
+	if err != nil {
+		return start, start, newError(ERR_CONFLICT, "Booking " + booking.BookingID + " has no valid ETB")
+	}
+	end, err := time.Parse(time.RFC3339, etd)
+	if err != nil {
+		return start, end, newError(ERR_CONFLICT, "Booking " + booking.BookingID + " has no valid ETD")
+	}
+	return start, end, nil
+}
+
+// ============================================================================================================================
+// checkBerthConflicts - fail if the allocated berth already has an approved booking whose window overlaps this one
+// ============================================================================================================================
+func checkBerthConflicts(stub shim.ChaincodeStubInterface, BerthChainCode string, booking Berth) error {
+	if booking.AllocatedBerth == "" {
+		return newError(ERR_CONFLICT, "No berth has been allocated to booking " + booking.BookingID)
+	}
+	start, end, err := bookingWindow(booking)
+	if err != nil {
+		return err
+	}
+	conflicts, err := findBerthConflicts(stub, BerthChainCode, booking.AllocatedBerth, booking.BookingID, start, end)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return newError(ERR_CONFLICT, "Berth " + booking.AllocatedBerth + " is already approved for an overlapping window to rotation number(s): " + strings.Join(conflicts, ", "))
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// fetchOccupyingBookings - the approved or berthed bookings allocated to a berth, read without the caller's terminal or
+// agent scope so a conflict is never missed. Only their booking ID, rotation number, status and windows are filled in.
+// ============================================================================================================================
+func fetchOccupyingBookings(stub shim.ChaincodeStubInterface, BerthChainCode string, BerthCode string) ([]Berth, error) {
+	f := "getBerth_occupancy"
+	queryArgs := util.ToChaincodeArgs(f, BerthCode)
+	bookingsAsBytes, err := unwrapResponse(stub.QueryChaincode(BerthChainCode, queryArgs))
+	if err != nil {
+		errStr := fmt.Sprintf("Failed to query chaincode. Got error: %s", err.Error())
+		fmt.Printf(errStr)
+		return nil, remoteError(errStr, err)
+	}
+	occupying := []Berth{}
+	json.Unmarshal(bookingsAsBytes, &occupying)
+	return occupying, nil
+}
+
+// ============================================================================================================================
+// findBerthConflicts - rotation numbers of the approved or berthed bookings on a berth that overlap a window,
+// the booking identified by BookingID is ignored so a booking never conflicts with itself
+// ============================================================================================================================
+func findBerthConflicts(stub shim.ChaincodeStubInterface, BerthChainCode string, BerthCode string, BookingID string, start time.Time, end time.Time) ([]string, error) {
+	bookings, err := fetchOccupyingBookings(stub, BerthChainCode, BerthCode)
+	if err != nil {
+		return nil, err
+	}
+	conflicts := []string{}
+	for _, other := range bookings {
+		if other.BookingID == BookingID {
+			continue
+		}
+		otherStart, otherEnd, err := bookingWindow(other)
+		if err != nil {
+			continue
+		}
+		if start.Before(otherEnd) && otherStart.Before(end) {
+			conflicts = append(conflicts, other.RotationNumber)
+		}
+	}
+	sort.Strings(conflicts)
+	return conflicts, nil
+}
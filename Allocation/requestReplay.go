@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var RequestPrefix = "_Request_" //prefix for the keys remembering processed request IDs
+
+// Longest request ID accepted
+var maxRequestIDLength = 128
+
+type ProcessedRequest struct { // Outcome of an invocation, kept so a retry gets the same answer
+	RequestID   string `json:"requestID"`
+	Function    string `json:"function"`
+	ArgsHash    string `json:"argsHash"` // SHA-256 of the JSON encoded arguments
+	Actor       string `json:"actor"`
+	TxID        string `json:"txID"`
+	TxTimestamp string `json:"txTimestamp"`
+	Result      []byte `json:"result"`
+}
+
+// ============================================================================================================================
+// invokeOnce - run an invocation whose first argument is the client's request ID. A request ID seen before gets the
+// stored answer of its first run back, nothing is run again and no event is sent. Only successful runs are
+// remembered: a failed transaction is discarded by the peer with everything it wrote, so it may safely be retried.
+// ============================================================================================================================
+func (t *ManageAllocations) invokeOnce(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	if len(args) == 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting a request ID before the function arguments")
+	}
+	requestID := strings.TrimSpace(args[0])
+	args = args[1:]
+	err := checkRequestID(requestID)
+	if err != nil {
+		return nil, err
+	}
+	actor, err := getActor(stub)
+	if err != nil {
+		return nil, err
+	}
+	argsAsBytes, _ := json.Marshal(args)
+	sum := sha256.Sum256(argsAsBytes)
+	argsHash := hex.EncodeToString(sum[:])
+
+	// Answer a retry from the first run
+	requestAsBytes, err := stub.GetState(RequestPrefix + requestID)
+	if err != nil {
+		return nil, errors.New("Failed to get state for request " + requestID)
+	}
+	if requestAsBytes != nil {
+		processed := ProcessedRequest{}
+		err = json.Unmarshal(requestAsBytes, &processed)
+		if err != nil {
+			return nil, errors.New("Corrupt request record " + requestID)
+		}
+		if processed.Actor != actor.ID() || processed.Function != function || processed.ArgsHash != argsHash {
+			return nil, &ChaincodeError{ResponseError{Code: ERR_CONFLICT, Message: "Request ID " + requestID + " was already used for a different invocation", Field: "requestID"}}
+		}
+		fmt.Println("replaying request " + requestID + " of " + function + " from transaction " + processed.TxID)
+		return processed.Result, nil
+	}
+
+	// First run, remember its answer
+	result, err := t.runInvocation(stub, function, args)
+	if err != nil {
+		return nil, err
+	}
+	processed := ProcessedRequest{
+		RequestID:   requestID,
+		Function:    function,
+		ArgsHash:    argsHash,
+		Actor:       actor.ID(),
+		TxID:        stub.GetTxID(),
+		TxTimestamp: actor.Time,
+		Result:      result,
+	}
+	requestAsBytes, _ = json.Marshal(processed)
+	err = stub.PutState(RequestPrefix+requestID, requestAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ============================================================================================================================
+// checkRequestID - make sure a request ID can be used as part of a key
+// ============================================================================================================================
+func checkRequestID(requestID string) error {
+	if requestID == "" {
+		return fieldError("requestID", "A request ID is required")
+	}
+	if len(requestID) > maxRequestIDLength || !utf8.ValidString(requestID) {
+		return fieldError("requestID", "Request ID must be valid text of at most "+strconv.Itoa(maxRequestIDLength)+" bytes")
+	}
+	for _, r := range requestID {
+		if unicode.IsControl(r) {
+			return fieldError("requestID", "Request ID must not contain control characters")
+		}
+	}
+	return nil
+}
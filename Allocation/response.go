@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// Error codes of the response envelope, shared by the Vessel, Berth and Allocation chaincodes.
+// Keep the three copies of this file in step.
+var ERR_NOT_FOUND = "NOT_FOUND"               // the record asked for is not on the ledger
+var ERR_ALREADY_EXISTS = "ALREADY_EXISTS"     // a record with that key is already on the ledger
+var ERR_INVALID_ARGUMENT = "INVALID_ARGUMENT" // the arguments or payload were refused, see field
+var ERR_FORBIDDEN = "FORBIDDEN"               // the caller may not do this
+var ERR_CONFLICT = "CONFLICT"                 // the request clashes with the current state of the record
+var ERR_INTERNAL = "INTERNAL"                 // the ledger could not be read or written
+
+type FieldError struct { // Why one payload field was refused
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type ResponseError struct { // Error part of the response envelope
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Field   string       `json:"field,omitempty"`   // argument or payload field at fault, if there is one
+	Details []FieldError `json:"details,omitempty"` // every refused payload field
+}
+
+type Response struct { // Envelope returned by every invoke and query, exactly one of data and error is set
+	Data  json.RawMessage `json:"data"`
+	Error *ResponseError  `json:"error,omitempty"`
+}
+
+// ChaincodeError is an error carrying an envelope error code
+type ChaincodeError struct {
+	ResponseError
+}
+
+func (e *ChaincodeError) Error() string { return e.Message }
+
+// ============================================================================================================================
+// newError - an error with an envelope error code
+// ============================================================================================================================
+func newError(code string, message string) error {
+	return &ChaincodeError{ResponseError{Code: code, Message: message}}
+}
+
+// ============================================================================================================================
+// fieldError - an INVALID_ARGUMENT error blaming one argument or payload field
+// ============================================================================================================================
+func fieldError(field string, message string) error {
+	return &ChaincodeError{ResponseError{Code: ERR_INVALID_ARGUMENT, Message: message, Field: field}}
+}
+
+// ============================================================================================================================
+// toResponseError - the envelope error for any error. Errors without a code are argument count mistakes or
+// ledger failures.
+// ============================================================================================================================
+func toResponseError(err error) *ResponseError {
+	if typed, ok := err.(*ChaincodeError); ok {
+		return &typed.ResponseError
+	}
+	if strings.HasPrefix(err.Error(), "Incorrect number of arguments") {
+		return &ResponseError{Code: ERR_INVALID_ARGUMENT, Message: err.Error()}
+	}
+	return &ResponseError{Code: ERR_INTERNAL, Message: err.Error()}
+}
+
+// ============================================================================================================================
+// respond - wrap the outcome of an invoke or query in the response envelope. A failure stays a failure so the
+// transaction is not committed, its message is the envelope.
+// ============================================================================================================================
+func respond(payload []byte, err error) ([]byte, error) {
+	response := Response{Data: json.RawMessage("null")}
+	if err != nil {
+		response.Error = toResponseError(err)
+		responseAsBytes, _ := json.Marshal(response)
+		return nil, errors.New(string(responseAsBytes))
+	}
+	if len(payload) > 0 {
+		var decoded interface{}
+		if json.Unmarshal(payload, &decoded) == nil {
+			response.Data = payload
+		} else {
+			response.Data, _ = json.Marshal(string(payload)) //plain text answers, e.g. a new booking ID
+		}
+	}
+	return json.Marshal(response)
+}
+
+// ============================================================================================================================
+// unwrapResponse - the data of an envelope returned by the Vessel or Berth chaincode, or its error with the code kept
+// ============================================================================================================================
+func unwrapResponse(payload []byte, err error) ([]byte, error) {
+	response := Response{}
+	if err != nil {
+		message := err.Error()
+		start := strings.Index(message, "{") //the peer may prefix the chaincode's message
+		if start >= 0 && json.Unmarshal([]byte(message[start:]), &response) == nil && response.Error != nil {
+			return nil, &ChaincodeError{*response.Error}
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(payload, &response)
+	if err != nil {
+		return nil, errors.New("Chaincode answer is not a response envelope")
+	}
+	if response.Error != nil {
+		return nil, &ChaincodeError{*response.Error}
+	}
+	return response.Data, nil
+}
+
+// ============================================================================================================================
+// hasCode - is err an error with the given envelope error code
+// ============================================================================================================================
+func hasCode(err error, code string) bool {
+	typed, ok := err.(*ChaincodeError)
+	return ok && typed.Code == code
+}
+
+// ============================================================================================================================
+// remoteError - describe a failed chaincode call, keeping the code the other chaincode gave
+// ============================================================================================================================
+func remoteError(message string, err error) error {
+	cause := toResponseError(err)
+	return &ChaincodeError{ResponseError{Code: cause.Code, Message: message, Field: cause.Field, Details: cause.Details}}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/util"
+)
+
+// A workflow moves a booking in the Berth chaincode and, while the booking holds it, its vessel in the Vessel chaincode
+// to the same status. A vessel has several bookings over time but carries the status of one, the booking named by
+// its activeBookingID. Both chaincodes are called inside this transaction, and a failing transaction is discarded by
+// the peer together with everything the chaincodes it called wrote, so a workflow is all-or-nothing as long as every
+// failure is returned. Both moves are checked up front so a workflow that cannot finish fails before it writes anything.
+
+// ============================================================================================================================
+// checkBookingStatusChange - make sure a booking may move to a status, a vessel the booking holds must not have
+// drifted from the booking's status
+// ============================================================================================================================
+func checkBookingStatusChange(BerthData Berth, VesselData Vessel, status string) error {
+	err := checkStatusTransition(BerthData.BerthBookingStatus, status)
+	if err != nil {
+		return err
+	}
+	if VesselData.ActiveBookingID != BerthData.BookingID {
+		return nil
+	}
+	if VesselData.BerthBookingStatus != BerthData.BerthBookingStatus {
+		return newError(ERR_CONFLICT, "Vessel "+VesselData.VesselID+" is '"+VesselData.BerthBookingStatus+"' but its booking "+BerthData.BookingID+" is '"+BerthData.BerthBookingStatus+"'")
+	}
+	return checkVesselStatusTransition(VesselData, BerthData.BookingID, status)
+}
+
+// ============================================================================================================================
+// movesVessel - does moving a booking to a status move its vessel too. The booking holding the vessel moves it, a
+// vessel no booking holds is taken by a booking that is not finishing and a vessel held by another booking stays.
+// ============================================================================================================================
+func movesVessel(BerthData Berth, VesselData Vessel, status string) bool {
+	if VesselData.ActiveBookingID == "" {
+		return !finishedStatus(status)
+	}
+	return VesselData.ActiveBookingID == BerthData.BookingID
+}
+
+// ============================================================================================================================
+// setBookingStatus - move a booking and, when it holds it, its vessel to a status. The booking goes first as the Berth
+// chaincode checks the most; a failure of either call fails the transaction and neither move is kept.
+// ============================================================================================================================
+func setBookingStatus(stub shim.ChaincodeStubInterface, VesselChaincode string, BerthChainCode string, BerthData Berth, VesselData Vessel, status string, approverID string, remarks string, reasonCode string) error {
+	err := checkBookingStatusChange(BerthData, VesselData, status)
+	if err != nil {
+		return err
+	}
+
+	f4 := "update_berth_allocationStatus"
+	invokeArgs2 := util.ToChaincodeArgs(f4, BerthData.BookingID, status, approverID, remarks, reasonCode)
+	_, err = unwrapResponse(stub.InvokeChaincode(BerthChainCode, invokeArgs2))
+	if err != nil {
+		errStr := fmt.Sprintf("Failed to update Transaction status from 'Berth' chaincode. Got error: %s", err.Error())
+		fmt.Printf(errStr)
+		return remoteError(errStr, err)
+	}
+
+	if !movesVessel(BerthData, VesselData, status) {
+		fmt.Println("Successfully updated allocation status to '" + status + "', vessel " + BerthData.VesselID + " is not held by this booking and is left as it is")
+		return nil
+	}
+
+	f3 := "update_vessel_allocationStatus"
+	invokeArgs1 := util.ToChaincodeArgs(f3, BerthData.VesselID, status, BerthData.BookingID)
+	_, err = unwrapResponse(stub.InvokeChaincode(VesselChaincode, invokeArgs1))
+	if err != nil {
+		errStr := fmt.Sprintf("Failed to update Transaction status from 'Vessel' chaincode, the booking status change is discarded. Got error: %s", err.Error())
+		fmt.Printf(errStr)
+		return remoteError(errStr, err)
+	}
+	fmt.Println("Successfully updated allocation status to '" + status + "'")
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// invokeStub records the chaincode functions a workflow invokes and answers each with an empty response envelope.
+// Stub functions the tests do not use are left to the embedded interface.
+type invokeStub struct {
+	shim.ChaincodeStubInterface
+	calls []string
+}
+
+func (m *invokeStub) InvokeChaincode(chaincodeName string, args [][]byte) ([]byte, error) {
+	m.calls = append(m.calls, chaincodeName+"."+string(args[0]))
+	return []byte(`{"data":null}`), nil
+}
+
+// vesselMoved - did a workflow invoke the Vessel chaincode
+func vesselMoved(stub *invokeStub) bool {
+	for _, call := range stub.calls {
+		if call == "vessel.update_vessel_allocationStatus" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTwoBookingsOnOneVessel(t *testing.T) {
+	approved := Berth{BookingID: "BK1", VesselID: "IMO9321483", BerthBookingStatus: STATUS_APPROVED}
+	waiting := Berth{BookingID: "BK2", VesselID: "IMO9321483", BerthBookingStatus: STATUS_NEW}
+	vessel := Vessel{VesselID: "IMO9321483", BerthBookingStatus: STATUS_APPROVED, ActiveBookingID: "BK1"}
+
+	// Cancelling the booking that does not hold the vessel leaves the vessel alone
+	stub := &invokeStub{}
+	err := setBookingStatus(stub, "vessel", "berth", waiting, vessel, STATUS_CANCELLED, "", "Agent withdrew", "AGENT_REQUEST")
+	if err != nil {
+		t.Fatalf("cancelling %s failed: %s", waiting.BookingID, err)
+	}
+	if len(stub.calls) != 1 || stub.calls[0] != "berth.update_berth_allocationStatus" {
+		t.Errorf("cancelling %s invoked %v, want only the Berth chaincode", waiting.BookingID, stub.calls)
+	}
+
+	// The booking holding the vessel still moves it on
+	stub = &invokeStub{}
+	err = setBookingStatus(stub, "vessel", "berth", approved, vessel, STATUS_BERTHED, "", "", "")
+	if err != nil {
+		t.Fatalf("berthing %s failed: %s", approved.BookingID, err)
+	}
+	if !vesselMoved(stub) {
+		t.Errorf("berthing %s invoked %v, want the vessel moved too", approved.BookingID, stub.calls)
+	}
+}
+
+func TestBookingStatusChangeNeedsVesselInStep(t *testing.T) {
+	res := Berth{BookingID: "BK1", VesselID: "IMO9321483", BerthBookingStatus: STATUS_APPROVED}
+	vessel := Vessel{VesselID: "IMO9321483", BerthBookingStatus: STATUS_IN_PROGRESS, ActiveBookingID: "BK1"}
+	err := checkBookingStatusChange(res, vessel, STATUS_BERTHED)
+	if !hasCode(err, ERR_CONFLICT) {
+		t.Errorf("vessel drifted from its booking: got %v, want %s", err, ERR_CONFLICT)
+	}
+
+	// A vessel held by another booking may be in any status
+	vessel.ActiveBookingID = "BK2"
+	err = checkBookingStatusChange(res, vessel, STATUS_BERTHED)
+	if err != nil {
+		t.Errorf("vessel held by another booking: got %v, want no error", err)
+	}
+}
+
+func TestFreeVesselTakenByNextBooking(t *testing.T) {
+	res := Berth{BookingID: "BK2", VesselID: "IMO9321483", BerthBookingStatus: STATUS_NEW}
+	vessel := Vessel{VesselID: "IMO9321483", BerthBookingStatus: STATUS_DEPARTED}
+
+	stub := &invokeStub{}
+	err := setBookingStatus(stub, "vessel", "berth", res, vessel, STATUS_IN_PROGRESS, "", "", "")
+	if err != nil {
+		t.Fatalf("moving %s to '%s' failed: %s", res.BookingID, STATUS_IN_PROGRESS, err)
+	}
+	if !vesselMoved(stub) {
+		t.Errorf("moving %s invoked %v, want the free vessel taken", res.BookingID, stub.calls)
+	}
+
+	// A booking finishing without ever holding the vessel does not take it
+	stub = &invokeStub{}
+	err = setBookingStatus(stub, "vessel", "berth", res, vessel, STATUS_CANCELLED, "", "Agent withdrew", "AGENT_REQUEST")
+	if err != nil {
+		t.Fatalf("cancelling %s failed: %s", res.BookingID, err)
+	}
+	if vesselMoved(stub) {
+		t.Errorf("cancelling %s invoked %v, want the vessel left free", res.BookingID, stub.calls)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/util"
+)
+
+type ReasonCode struct { // One entry of the reason code catalogue kept by the Berth chaincode
+	Code        string   `json:"code"`
+	Description string   `json:"description"`
+	Statuses    []string `json:"statuses"` // booking statuses the code may be given for
+	Active      bool     `json:"active"`
+}
+
+type StatusEvent struct { // Event sent when a booking is rejected or cancelled
+	BookingID         string `json:"bookingID"`
+	VesselID          string `json:"vesselID"`
+	AgentRefNumber    string `json:"agentRefNumber"`
+	Status            string `json:"status"`
+	ReasonCode        string `json:"reasonCode"`
+	ReasonDescription string `json:"reasonDescription"`
+	Remarks           string `json:"remarks"`
+	Actor             string `json:"actor"`
+	TxTimestamp       string `json:"txTimestamp"`
+}
+
+// ============================================================================================================================
+// normalizeReasonCode - reason codes are stored in upper case, the same rule as the Berth chaincode
+// ============================================================================================================================
+func normalizeReasonCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// ============================================================================================================================
+// fetchReasonCode - get a reason code from the Berth chaincode and make sure it may be given for a status, remarks
+// saying more are required with it
+// ============================================================================================================================
+func fetchReasonCode(stub shim.ChaincodeStubInterface, BerthChainCode string, Code string, Remarks string, status string) (ReasonCode, error) {
+	ReasonData := ReasonCode{}
+	Code = normalizeReasonCode(Code)
+	if Code == "" {
+		return ReasonData, fieldError("reasonCode", "A reason code is required to move a booking to '"+status+"'")
+	}
+	if strings.TrimSpace(Remarks) == "" {
+		return ReasonData, fieldError("remarks", "Remarks are required to move a booking to '"+status+"'")
+	}
+	f := "getReasonCode_byCode"
+	queryArgs := util.ToChaincodeArgs(f, Code)
+	codeAsBytes, err := unwrapResponse(stub.QueryChaincode(BerthChainCode, queryArgs))
+	if err != nil && !hasCode(err, ERR_NOT_FOUND) {
+		errStr := fmt.Sprintf("Failed to query chaincode. Got error: %s", err.Error())
+		fmt.Printf(errStr)
+		return ReasonData, remoteError(errStr, err)
+	}
+	json.Unmarshal(codeAsBytes, &ReasonData)
+	if ReasonData.Code != Code || !ReasonData.Active {
+		return ReasonData, fieldError("reasonCode", "Unknown or retired reason code '"+Code+"'")
+	}
+	for _, s := range ReasonData.Statuses {
+		if s == status {
+			return ReasonData, nil
+		}
+	}
+	return ReasonData, fieldError("reasonCode", "Reason code '"+Code+"' may not be given for '"+status+"'")
+}
+
+// ============================================================================================================================
+// emitStatusEvent - tell listeners why a booking was rejected or cancelled
+// ============================================================================================================================
+func emitStatusEvent(stub shim.ChaincodeStubInterface, BerthData Berth, status string, reason ReasonCode, Remarks string, actor Actor) error {
+	event := StatusEvent{
+		BookingID:         BerthData.BookingID,
+		VesselID:          BerthData.VesselID,
+		AgentRefNumber:    BerthData.AgentRefNumber,
+		Status:            status,
+		ReasonCode:        reason.Code,
+		ReasonDescription: reason.Description,
+		Remarks:           Remarks,
+		Actor:             actor.ID(),
+		TxTimestamp:       actor.Time,
+	}
+	eventAsBytes, _ := json.Marshal(event)
+	return stub.SetEvent("evtsender", eventAsBytes)
+}
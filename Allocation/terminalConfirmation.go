@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// The terminal operator of a booking's terminal confirms or declines its allocation before the port authority may
+// approve it:
+//
+//	New -> In Progress -> Confirmed -> Approved     terminal operator confirms, port authority approves
+//	               \----> Declined -> In Progress   terminal operator declines, the allocation is reworked
+//
+// The signer and time of each stage are stored on the booking (toID, toDecision, toDecisionAt, toRemarks and
+// approverID, paDecision, paDecisionAt, paRemarks) and in its status history.
+
+// ============================================================================================================================
+// Confirm Allocation - the terminal operator accepts the berth and window allocated to a booking
+// ============================================================================================================================
+func (t *ManageAllocations) confirm_allocation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting BookingID and optional remarks")
+	}
+	fmt.Println("start confirm_allocation")
+
+	// Alloting Params
+	BookingID := args[0]
+	Remarks := ""
+	if len(args) == 2 {
+		Remarks = strings.TrimSpace(args[1])
+	}
+
+	//-----------------------------------------------------------------------------
+
+	// Vessel and Berth chaincodes configured by the admin
+	VesselChaincode, BerthChainCode, err := chaincodeRefs(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch Berth booking details from Blockchain
+	BerthData, err := fetchBooking(stub, BerthChainCode, BookingID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch Vessel details from Blockchain
+	VesselData, err := fetchVessel(stub, VesselChaincode, BerthData.VesselID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure the caller may move this booking to "Confirmed"
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = checkStatusPermission(caller, BerthData, STATUS_CONFIRMED)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure the booking and its vessel may move to "Confirmed"
+	err = checkBookingStatusChange(BerthData, VesselData, STATUS_CONFIRMED)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure the allocated berth is still free for the allocated window
+	err = checkBerthConflicts(stub, BerthChainCode, BerthData)
+	if err != nil {
+		return nil, err
+	}
+
+	err = setBookingStatus(stub, VesselChaincode, BerthChainCode, BerthData, VesselData, STATUS_CONFIRMED, "", Remarks, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Record the step on the booking's allocation
+	BerthData.BerthBookingStatus = STATUS_CONFIRMED
+	_, err = recordAllocation(stub, BerthData, "confirm_allocation", Remarks)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("end confirm_allocation")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Decline Allocation - the terminal operator refuses the allocation, remarks saying why are required
+// ============================================================================================================================
+func (t *ManageAllocations) decline_allocation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2 args: BookingID, remarks")
+	}
+	fmt.Println("start decline_allocation")
+
+	// Alloting Params
+	BookingID := args[0]
+	Remarks := strings.TrimSpace(args[1])
+	if Remarks == "" {
+		return nil, fieldError("remarks", "Remarks are required to decline an allocation")
+	}
+
+	//-----------------------------------------------------------------------------
+
+	// Vessel and Berth chaincodes configured by the admin
+	VesselChaincode, BerthChainCode, err := chaincodeRefs(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch Berth booking details from Blockchain
+	BerthData, err := fetchBooking(stub, BerthChainCode, BookingID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch Vessel details from Blockchain
+	VesselData, err := fetchVessel(stub, VesselChaincode, BerthData.VesselID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure the caller may move this booking to "Declined"
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = checkStatusPermission(caller, BerthData, STATUS_DECLINED)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure the booking and its vessel may move to "Declined"
+	err = checkBookingStatusChange(BerthData, VesselData, STATUS_DECLINED)
+	if err != nil {
+		return nil, err
+	}
+
+	err = setBookingStatus(stub, VesselChaincode, BerthChainCode, BerthData, VesselData, STATUS_DECLINED, "", Remarks, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Record the step on the booking's allocation
+	BerthData.BerthBookingStatus = STATUS_DECLINED
+	_, err = recordAllocation(stub, BerthData, "decline_allocation", Remarks)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("end decline_allocation")
+	return nil, nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Roles carried in the "role" attribute of the caller's enrollment certificate, shared by the Vessel, Berth and
+// Allocation chaincodes. Keep the three copies of the roles and statusRoles in step. Every certificate also carries
+// an "org" attribute, recorded as the organization of each change the caller signs.
+//
+//	agent              - shipping agent, its "org" attribute is the agent reference number on its bookings
+//	terminal_operator  - its "terminal" attribute names the terminal it runs
+//	port_authority     - approves and rejects allocations
+//	admin              - may do everything, including maintenance functions
+var ROLE_AGENT = "agent"
+var ROLE_TERMINAL_OPERATOR = "terminal_operator"
+var ROLE_PORT_AUTHORITY = "port_authority"
+var ROLE_ADMIN = "admin"
+
+var ANY_ROLE = []string{ROLE_AGENT, ROLE_TERMINAL_OPERATOR, ROLE_PORT_AUTHORITY}
+
+type Caller struct { // Identity of the caller as read from its certificate attributes
+	Role     string `json:"role"`
+	Org      string `json:"org"`
+	UserID   string `json:"userID"`
+	Terminal string `json:"terminal"`
+}
+
+// Roles allowed to call each function, admin may call all of them. Ownership of the booking is checked by the
+// function itself. Functions missing here are rejected by the dispatch as unknown.
+var functionRoles = map[string][]string{
+	"init":                          {},
+	"create_berth":                  {ROLE_AGENT},
+	"update_berth":                  {ROLE_AGENT},
+	"delete_berth":                  {},
+	"update_berth_allocationStatus": ANY_ROLE, // see statusRoles, only admin outside the Allocation workflows
+	"update_berth_allocation":       {ROLE_TERMINAL_OPERATOR, ROLE_PORT_AUTHORITY},
+	"migrate_berth_bookingIDs":      {},
+	"create_berth_master":           {ROLE_PORT_AUTHORITY},
+	"update_berth_master":           {ROLE_PORT_AUTHORITY},
+	"retire_berth_master":           {ROLE_PORT_AUTHORITY},
+	"reactivate_berth_master":       {ROLE_PORT_AUTHORITY},
+	"set_reason_code":               {ROLE_PORT_AUTHORITY},
+	"retire_reason_code":            {ROLE_PORT_AUTHORITY},
+	"repair_berth_records":          {},
+	"migrate_berth_index":           {},
+	"set_chaincode_references":      {},
+	"getBerth_byBookingID":          ANY_ROLE,
+	"getBerth_byVesselID":           ANY_ROLE,
+	"getBerth_byTO":                 ANY_ROLE,
+	"getBerth_byOwner":              ANY_ROLE,
+	"getBerth_bySA":                 ANY_ROLE,
+	"getBerth_byPA":                 ANY_ROLE,
+	"query_bookings":                ANY_ROLE,
+	"get_AllBerth":                  ANY_ROLE,
+	"getBerth_history":              ANY_ROLE,
+	"getBerth_byAllocatedBerth":     ANY_ROLE,
+	"getBerth_occupancy":            ANY_ROLE, // unscoped, scheduling fields only
+	"get_chaincode_references":      ANY_ROLE,
+	"getBerthMaster_byCode":         ANY_ROLE,
+	"get_AllBerthMaster":            ANY_ROLE,
+	"getReasonCode_byCode":          ANY_ROLE,
+	"get_AllReasonCodes":            ANY_ROLE,
+	"validate_berth_records":        {},
+}
+
+// Roles allowed to move a booking to each status, admin may make every move
+var statusRoles = map[string][]string{
+	STATUS_IN_PROGRESS: {ROLE_TERMINAL_OPERATOR, ROLE_PORT_AUTHORITY},
+	STATUS_CONFIRMED:   {ROLE_TERMINAL_OPERATOR},
+	STATUS_DECLINED:    {ROLE_TERMINAL_OPERATOR},
+	STATUS_APPROVED:    {ROLE_PORT_AUTHORITY},
+	STATUS_REJECTED:    {ROLE_PORT_AUTHORITY},
+	STATUS_BERTHED:     {ROLE_TERMINAL_OPERATOR},
+	STATUS_DEPARTED:    {ROLE_TERMINAL_OPERATOR},
+	STATUS_CANCELLED:   {ROLE_AGENT},
+}
+
+type Actor struct { // Signed identity behind a state change
+	MSPID   string `json:"mspID"`   // organization of the caller, the "org" attribute of its certificate
+	Subject string `json:"subject"` // subject common name of the caller's certificate
+	Time    string `json:"time"`    // transaction timestamp, RFC3339
+}
+
+// ============================================================================================================================
+// getActor - the identity that signed the transaction and the transaction time, for stamping state changes
+// ============================================================================================================================
+func getActor(stub shim.ChaincodeStubInterface) (Actor, error) {
+	caller, err := getCaller(stub)
+	if err != nil {
+		return Actor{}, err
+	}
+	subject := certificateSubject(stub)
+	if subject == "" {
+		subject = caller.UserID //certificates without a readable subject
+	}
+	if subject == "" {
+		return Actor{}, newError(ERR_FORBIDDEN, "Caller certificate carries neither a subject nor a userID attribute")
+	}
+	timestamp, err := txTimestamp(stub)
+	if err != nil {
+		return Actor{}, err
+	}
+	return Actor{MSPID: caller.Org, Subject: subject, Time: timestamp}, nil
+}
+
+// ============================================================================================================================
+// certificateSubject - common name of the caller's certificate, empty when it cannot be read
+// ============================================================================================================================
+func certificateSubject(stub shim.ChaincodeStubInterface) string {
+	certAsBytes, err := stub.GetCallerCertificate()
+	if err != nil || len(certAsBytes) == 0 {
+		return ""
+	}
+	if block, _ := pem.Decode(certAsBytes); block != nil {
+		certAsBytes = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(certAsBytes)
+	if err != nil {
+		return ""
+	}
+	return cert.Subject.CommonName
+}
+
+// ============================================================================================================================
+// ID - how an actor is written on a record, MSP ID / certificate subject
+// ============================================================================================================================
+func (a Actor) ID() string {
+	return a.MSPID + "/" + a.Subject
+}
+
+// ============================================================================================================================
+// checkApprover - the signer of an approval or rejection, refused when the approver ID given names someone else.
+// A blank approver ID stands for the signer.
+// ============================================================================================================================
+func checkApprover(stub shim.ChaincodeStubInterface, approverID string) (Actor, error) {
+	actor, err := getActor(stub)
+	if err != nil {
+		return actor, err
+	}
+	approverID = strings.TrimSpace(approverID)
+	if approverID != "" && !actor.matches(approverID) {
+		return actor, &ChaincodeError{ResponseError{Code: ERR_FORBIDDEN, Message: "Approver ID '" + approverID + "' does not match the signer " + actor.ID(), Field: "approverID"}}
+	}
+	return actor, nil
+}
+
+// ============================================================================================================================
+// errApproverNotEditable - the refusal of an approver ID written by create_berth or update_berth
+// ============================================================================================================================
+func errApproverNotEditable() error {
+	return &ChaincodeError{ResponseError{Code: ERR_FORBIDDEN, Message: "The approver is recorded from the signer of approve_allocation or reject_allocation", Field: "approverID"}}
+}
+
+// ============================================================================================================================
+// errAllocationNotEditable - the refusal of a terminal operator or allocated berth and window written by update_berth
+// ============================================================================================================================
+func errAllocationNotEditable(field string) error {
+	return &ChaincodeError{ResponseError{Code: ERR_FORBIDDEN, Message: "The terminal operator and the allocated berth and window are recorded by the allocation workflow", Field: field}}
+}
+
+// ============================================================================================================================
+// matches - does an approver ID given as an argument name this actor, by its full ID or its certificate subject
+// ============================================================================================================================
+func (a Actor) matches(id string) bool {
+	return id == a.ID() || id == a.Subject
+}
+
+// ============================================================================================================================
+// getCaller - read the caller's role and organization from the transaction certificate
+// ============================================================================================================================
+func getCaller(stub shim.ChaincodeStubInterface) (Caller, error) {
+	caller := Caller{
+		Role:     readAttribute(stub, "role"),
+		Org:      readAttribute(stub, "org"),
+		UserID:   readAttribute(stub, "userID"),
+		Terminal: readAttribute(stub, "terminal"),
+	}
+	if caller.Role != ROLE_ADMIN && !caller.hasRole(ANY_ROLE) {
+		return caller, newError(ERR_FORBIDDEN, "Caller certificate carries no known role attribute")
+	}
+	if caller.Org == "" {
+		return caller, newError(ERR_FORBIDDEN, "Caller certificate carries no org attribute")
+	}
+	if caller.Role == ROLE_TERMINAL_OPERATOR && caller.Terminal == "" {
+		return caller, newError(ERR_FORBIDDEN, "Terminal operator certificate carries no terminal attribute")
+	}
+	return caller, nil
+}
+
+// ============================================================================================================================
+// readAttribute - one attribute of the caller's certificate, empty when it is missing
+// ============================================================================================================================
+func readAttribute(stub shim.ChaincodeStubInterface, name string) string {
+	value, err := stub.ReadCertAttribute(name)
+	if err != nil {
+		return ""
+	}
+	return string(value)
+}
+
+// ============================================================================================================================
+// hasRole - is the caller an admin or one of the given roles
+// ============================================================================================================================
+func (c Caller) hasRole(roles []string) bool {
+	if c.Role == ROLE_ADMIN {
+		return true
+	}
+	for _, role := range roles {
+		if c.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================================================================================
+// authorize - make sure the caller holds a role allowed to call a function
+// ============================================================================================================================
+func authorize(stub shim.ChaincodeStubInterface, function string) error {
+	roles, ok := functionRoles[function]
+	if !ok {
+		return nil
+	}
+	caller, err := getCaller(stub)
+	if err != nil {
+		return err
+	}
+	if !caller.hasRole(roles) {
+		fmt.Println("denied " + function + " to role " + caller.Role)
+		return newError(ERR_FORBIDDEN, "Role '"+caller.Role+"' may not call "+function)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// canSee - may the caller read a booking. Agents see their own bookings and terminal operators those of their terminal.
+// ============================================================================================================================
+func (c Caller) canSee(res Berth) bool {
+	if c.Role == ROLE_AGENT {
+		return res.AgentRefNumber == c.Org
+	}
+	if c.Role == ROLE_TERMINAL_OPERATOR {
+		return res.Terminal == c.Terminal
+	}
+	return true
+}
+
+// ============================================================================================================================
+// bookingScope - the filter limiting a listing to the bookings the caller may see, nil when it may see them all
+// ============================================================================================================================
+func (c Caller) bookingScope() *BookingFilter {
+	if c.Role == ROLE_AGENT {
+		return &BookingFilter{Field: "agentRefNumber", Eq: &c.Org}
+	}
+	if c.Role == ROLE_TERMINAL_OPERATOR {
+		return &BookingFilter{Field: "terminal", Eq: &c.Terminal}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// checkBookingAccess - make sure the caller may act on a booking
+// ============================================================================================================================
+func checkBookingAccess(caller Caller, res Berth) error {
+	if !caller.canSee(res) {
+		return newError(ERR_FORBIDDEN, "Booking "+res.BookingID+" does not belong to the caller's organization or terminal")
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// checkStatusPermission - make sure the caller may move a booking to a status
+// ============================================================================================================================
+func checkStatusPermission(caller Caller, res Berth, status string) error {
+	if !caller.hasRole(statusRoles[status]) {
+		return newError(ERR_FORBIDDEN, "Role '"+caller.Role+"' may not move a booking to '"+status+"'")
+	}
+	return checkBookingAccess(caller, res)
+}
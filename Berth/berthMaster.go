@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var BerthMasterIndexStr = "_BerthMasterindex" //legacy list of all known berth codes, masters are now listed by key prefix
+var BerthMasterPrefix = "_BerthMaster_"       //prefix for berth master keys so they never clash with booking keys
+
+type BerthMaster struct { // Attributes of a physical berth
+	BerthCode          string   `json:"berthCode"`
+	Terminal           string   `json:"terminal"`
+	QuayLength         float64  `json:"quayLength"`      // metres
+	MaxDraft           float64  `json:"maxDraft"`        // metres
+	MaxLOA             float64  `json:"maxLOA"`          // metres
+	BollardCapacity    float64  `json:"bollardCapacity"` // tonnes
+	AllowedVesselTypes []string `json:"allowedVesselTypes"`
+	Active             bool     `json:"active"`
+	LastModifiedBy     string   `json:"lastModifiedBy"` // signer of the latest change, MSP ID / certificate subject
+	LastModifiedAt     string   `json:"lastModifiedAt"` // transaction timestamp, RFC3339
+}
+
+// ============================================================================================================================
+// getBerthMaster - read a berth master record, returns nil if the berth code is unknown
+// ============================================================================================================================
+func getBerthMaster(stub shim.ChaincodeStubInterface, berthCode string) (*BerthMaster, error) {
+	masterAsBytes, err := stub.GetState(BerthMasterPrefix + berthCode)
+	if err != nil {
+		return nil, errors.New("Failed to get state for berth " + berthCode)
+	}
+	if masterAsBytes == nil {
+		return nil, nil
+	}
+	res := BerthMaster{}
+	err = json.Unmarshal(masterAsBytes, &res)
+	if err != nil {
+		return nil, errors.New("Corrupt berth master record for " + berthCode)
+	}
+	return &res, nil
+}
+
+// ============================================================================================================================
+// saveBerthMaster - stamp a berth master record with the signer and time of the change and store it
+// ============================================================================================================================
+func saveBerthMaster(stub shim.ChaincodeStubInterface, res BerthMaster) error {
+	actor, err := getActor(stub)
+	if err != nil {
+		return err
+	}
+	res.LastModifiedBy = actor.ID()
+	res.LastModifiedAt = actor.Time
+	masterAsBytes, _ := json.Marshal(res)
+	return stub.PutState(BerthMasterPrefix+res.BerthCode, masterAsBytes)
+}
+
+// ============================================================================================================================
+// checkBerthMaster - make sure a berth referenced by a booking exists in the registry and is still in service
+// ============================================================================================================================
+func checkBerthMaster(stub shim.ChaincodeStubInterface, field string, berthCode string) error {
+	if strings.TrimSpace(berthCode) == "" {
+		return nil
+	}
+	master, err := getBerthMaster(stub, berthCode)
+	if err != nil {
+		return err
+	}
+	if master == nil {
+		return newError(ERR_NOT_FOUND, field+" "+berthCode+" does not exist in the berth registry")
+	}
+	if !master.Active {
+		return newError(ERR_CONFLICT, field+" "+berthCode+" is retired")
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// checkBerthTerminal - make sure a registered berth belongs to the terminal a booking is for
+// ============================================================================================================================
+func checkBerthTerminal(stub shim.ChaincodeStubInterface, berthCode string, res Berth) error {
+	master, err := getBerthMaster(stub, berthCode)
+	if err != nil {
+		return err
+	}
+	if master == nil || master.Terminal == res.Terminal {
+		return nil
+	}
+	return &ChaincodeError{ResponseError{Code: ERR_CONFLICT, Message: "Berth " + berthCode + " is on terminal '" + master.Terminal + "', booking " + res.BookingID + " is for terminal '" + res.Terminal + "'", Field: "allocatedBerth"}}
+}
+
+// ============================================================================================================================
+// parseBerthMasterArgs - build a berth master from the positional create/update arguments
+// ============================================================================================================================
+func parseBerthMasterArgs(args []string) (BerthMaster, error) {
+	res := BerthMaster{}
+	res.BerthCode = strings.TrimSpace(args[0])
+	if res.BerthCode == "" {
+		return res, newError(ERR_INVALID_ARGUMENT, "Berth code must not be empty")
+	}
+	res.Terminal = args[1]
+	numbers := []string{"quayLength", "maxDraft", "maxLOA", "bollardCapacity"}
+	values := make([]float64, len(numbers))
+	for i, name := range numbers {
+		value, err := strconv.ParseFloat(strings.TrimSpace(args[i+2]), 64)
+		if err != nil || value < 0 {
+			return res, newError(ERR_INVALID_ARGUMENT, name+" must be a non-negative number")
+		}
+		values[i] = value
+	}
+	res.QuayLength = values[0]
+	res.MaxDraft = values[1]
+	res.MaxLOA = values[2]
+	res.BollardCapacity = values[3]
+	res.AllowedVesselTypes = []string{}
+	for _, vesselType := range strings.Split(args[6], ",") {
+		vesselType = strings.TrimSpace(vesselType)
+		if vesselType != "" {
+			res.AllowedVesselTypes = append(res.AllowedVesselTypes, vesselType)
+		}
+	}
+	return res, nil
+}
+
+// ============================================================================================================================
+// create_berth_master - register a new physical berth
+// ============================================================================================================================
+func (t *ManageBerth) create_berth_master(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 7 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 7: berthCode, terminal, quayLength, maxDraft, maxLOA, bollardCapacity, allowedVesselTypes")
+	}
+	fmt.Println("start create_berth_master")
+	res, err := parseBerthMasterArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := getBerthMaster(stub, res.BerthCode)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, newError(ERR_ALREADY_EXISTS, "This berth code already exists")
+	}
+	res.Active = true
+	err = saveBerthMaster(stub, res)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("end create_berth_master")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// update_berth_master - change the particulars of a registered berth, the active flag is left to retire_berth_master and
+// reactivate_berth_master
+// ============================================================================================================================
+func (t *ManageBerth) update_berth_master(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 7 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 7: berthCode, terminal, quayLength, maxDraft, maxLOA, bollardCapacity, allowedVesselTypes")
+	}
+	fmt.Println("start update_berth_master")
+	res, err := parseBerthMasterArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := getBerthMaster(stub, res.BerthCode)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		return nil, newError(ERR_NOT_FOUND, "Berth "+res.BerthCode+" does not exist in the berth registry")
+	}
+	res.Active = existing.Active
+	err = saveBerthMaster(stub, res)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("end update_berth_master")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// retire_berth_master - take a berth out of service, it stays in the registry for existing bookings
+// ============================================================================================================================
+func (t *ManageBerth) retire_berth_master(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting berth code")
+	}
+	fmt.Println("start retire_berth_master")
+	res, err := getBerthMaster(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, newError(ERR_NOT_FOUND, "Berth "+args[0]+" does not exist in the berth registry")
+	}
+	res.Active = false
+	err = saveBerthMaster(stub, *res)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("end retire_berth_master")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// reactivate_berth_master - put a retired berth back into service
+// ============================================================================================================================
+func (t *ManageBerth) reactivate_berth_master(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting berth code")
+	}
+	fmt.Println("start reactivate_berth_master")
+	res, err := getBerthMaster(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, newError(ERR_NOT_FOUND, "Berth "+args[0]+" does not exist in the berth registry")
+	}
+	if res.Active {
+		return nil, newError(ERR_CONFLICT, "Berth "+args[0]+" is already in service")
+	}
+	res.Active = true
+	err = saveBerthMaster(stub, *res)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("end reactivate_berth_master")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// getBerthMaster_byCode - get the registry entry for a berth code
+// ============================================================================================================================
+func (t *ManageBerth) getBerthMaster_byCode(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting berth code")
+	}
+	fmt.Println("start getBerthMaster_byCode")
+	masterAsBytes, err := stub.GetState(BerthMasterPrefix + args[0])
+	if err != nil {
+		return nil, errors.New("Failed to get state for berth " + args[0])
+	}
+	if masterAsBytes == nil {
+		return nil, newError(ERR_NOT_FOUND, "Berth "+args[0]+" does not exist in the berth registry")
+	}
+	fmt.Println("end getBerthMaster_byCode")
+	return masterAsBytes, nil
+}
+
+// ============================================================================================================================
+// get_AllBerthMaster - get every berth in the registry, keyed by berth code
+// ============================================================================================================================
+func (t *ManageBerth) get_AllBerthMaster(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("start get_AllBerthMaster")
+	keysIter, err := stub.RangeQueryState(BerthMasterPrefix, BerthMasterPrefix+string(utf8.MaxRune))
+	if err != nil {
+		return nil, errors.New("Failed to scan berth masters")
+	}
+	defer keysIter.Close()
+	masters := make(map[string]BerthMaster)
+	for keysIter.HasNext() {
+		key, masterAsBytes, err := keysIter.Next()
+		if err != nil {
+			return nil, errors.New("Failed to scan berth masters")
+		}
+		res := BerthMaster{}
+		err = json.Unmarshal(masterAsBytes, &res)
+		if err != nil {
+			fmt.Println("skipping malformed berth master " + key)
+			continue
+		}
+		masters[res.BerthCode] = res
+	}
+	jsonAsBytes, _ := json.Marshal(masters)
+	fmt.Println("end get_AllBerthMaster")
+	return jsonAsBytes, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+type RecordProblem struct { // A stored booking that could not be read
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+type RecordReport struct { // Result of validate_berth_records and repair_berth_records
+	Checked    int             `json:"checked"`
+	Malformed  []RecordProblem `json:"malformed"`
+	Repaired   []string        `json:"repaired"`
+	Normalized []string        `json:"normalized"` // readable but not in the canonical marshalled form
+}
+
+// ============================================================================================================================
+// saveBerth - stamp a booking with the signer and time of the change, marshal it, store it under its booking ID and keep its
+// secondary indexes in step
+// ============================================================================================================================
+func saveBerth(stub shim.ChaincodeStubInterface, res Berth) error {
+	actor, err := getActor(stub)
+	if err != nil {
+		return err
+	}
+	res.LastModifiedBy = actor.ID()
+	res.LastModifiedAt = actor.Time
+	berthAsBytes, err := json.Marshal(res)
+	if err != nil {
+		return errors.New("Failed to marshal booking " + res.BookingID)
+	}
+	old, err := getBerth(stub, res.BookingID)
+	if err != nil {
+		old = nil													//unreadable records have no index entries worth keeping
+	}
+	err = stub.PutState(res.BookingID, berthAsBytes)									//store Berth with bookingID as key
+	if err != nil {
+		return err
+	}
+	return updateBookingIndexes(stub, old, &res)
+}
+
+// ============================================================================================================================
+// getBerth - read a booking, returns nil when the booking ID is unknown
+// ============================================================================================================================
+func getBerth(stub shim.ChaincodeStubInterface, bookingID string) (*Berth, error) {
+	berthAsBytes, err := stub.GetState(bookingID)
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + bookingID)
+	}
+	if berthAsBytes == nil {
+		return nil, nil
+	}
+	res := Berth{}
+	err = json.Unmarshal(berthAsBytes, &res)
+	if err != nil {
+		return nil, errors.New("Booking " + bookingID + " is malformed, run repair_berth_records")
+	}
+	return &res, nil
+}
+
+// ============================================================================================================================
+// checkBerthRecords - walk every booking in the index, optionally rewriting the ones that can be recovered
+// ============================================================================================================================
+func checkBerthRecords(stub shim.ChaincodeStubInterface, repair bool) (RecordReport, error) {
+	report := RecordReport{Malformed: []RecordProblem{}, Repaired: []string{}, Normalized: []string{}}
+	berthIndex, err := getBerthIndex(stub)
+	if err != nil {
+		return report, err
+	}
+	for _, key := range berthIndex {
+		valueAsBytes, err := stub.GetState(key)
+		if err != nil {
+			return report, errors.New("Failed to get state for " + key)
+		}
+		if valueAsBytes == nil {
+			continue
+		}
+		report.Checked++
+		res := Berth{}
+		err = json.Unmarshal(valueAsBytes, &res)
+		if err == nil {
+			canonical, _ := json.Marshal(res)
+			if string(canonical) != string(valueAsBytes) {
+				report.Normalized = append(report.Normalized, key)
+				if repair {
+					err = stub.PutState(key, canonical)
+					if err != nil {
+						return report, err
+					}
+				}
+			}
+			continue
+		}
+		if !repair {
+			report.Malformed = append(report.Malformed, RecordProblem{key, err.Error()})
+			continue
+		}
+		res = Berth{}
+		recoverErr := recoverLegacyRecord(valueAsBytes, &res)
+		if recoverErr != nil {
+			report.Malformed = append(report.Malformed, RecordProblem{key, err.Error() + "; not recoverable: " + recoverErr.Error()})
+			continue
+		}
+		if res.BookingID == key {
+			err = saveBerth(stub, res)
+		} else {												//legacy record still keyed by vesselID, migrate_berth_bookingIDs moves it
+			repaired, _ := json.Marshal(res)
+			err = stub.PutState(key, repaired)
+		}
+		if err != nil {
+			return report, err
+		}
+		report.Repaired = append(report.Repaired, key)
+	}
+	return report, nil
+}
+
+// ============================================================================================================================
+// validate_berth_records - report every stored booking that is not readable JSON or not in canonical form
+// ============================================================================================================================
+func (t *ManageBerth) validate_berth_records(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("start validate_berth_records")
+	report, err := checkBerthRecords(stub, false)
+	if err != nil {
+		return nil, err
+	}
+	reportAsBytes, _ := json.Marshal(report)
+	fmt.Println("end validate_berth_records")
+	return reportAsBytes, nil
+}
+
+// ============================================================================================================================
+// repair_berth_records - rewrite every stored booking in canonical form, recovering the malformed ones where possible
+// ============================================================================================================================
+func (t *ManageBerth) repair_berth_records(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("start repair_berth_records")
+	report, err := checkBerthRecords(stub, true)
+	if err != nil {
+		return nil, err
+	}
+	reportAsBytes, _ := json.Marshal(report)
+	fmt.Println("end repair_berth_records")
+	return reportAsBytes, nil
+}
+
+// ============================================================================================================================
+// jsonFieldNames - the JSON names of a struct's fields, in declaration order
+// ============================================================================================================================
+func jsonFieldNames(record interface{}) []string {
+	names := []string{}
+	recordType := reflect.TypeOf(record)
+	for i := 0; i < recordType.NumField(); i++ {
+		name := strings.Split(recordType.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+type fieldMarker struct { // Position of a `"name":` marker inside a legacy record
+	name  string
+	start int
+	end   int
+}
+
+// byOffset orders field markers by their position in the record
+type byOffset []fieldMarker
+
+func (m byOffset) Len() int           { return len(m) }
+func (m byOffset) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m byOffset) Less(i, j int) bool { return m[i].start < m[j].start }
+
+// ============================================================================================================================
+// recoverLegacyRecord - rebuild a record written by the old string concatenation, where an unescaped quote in a
+// value made the JSON unreadable. Every known field is located by its `"name":` marker and its value runs up to
+// the next marker, so quotes inside values no longer matter.
+// ============================================================================================================================
+func recoverLegacyRecord(raw []byte, target interface{}) error {
+	text := strings.TrimSpace(string(raw))
+	if !strings.HasPrefix(text, "{") || !strings.HasSuffix(text, "}") {
+		return errors.New("record is not a JSON object")
+	}
+	text = text[1 : len(text)-1]
+
+	markers := []fieldMarker{}
+	for _, name := range jsonFieldNames(reflect.ValueOf(target).Elem().Interface()) {
+		search := 0
+		for {
+			at := strings.Index(text[search:], "\""+name+"\":")
+			if at < 0 {
+				break
+			}
+			at += search
+			markers = append(markers, fieldMarker{name, at, at + len(name) + 3})
+			search = at + len(name) + 3
+		}
+	}
+	if len(markers) == 0 {
+		return errors.New("no known fields found")
+	}
+	sort.Sort(byOffset(markers))
+
+	recovered := make(map[string]interface{})
+	for i, m := range markers {
+		valueEnd := len(text)
+		if i+1 < len(markers) {
+			valueEnd = markers[i+1].start
+		}
+		value := strings.TrimSpace(text[m.end:valueEnd])
+		value = strings.TrimSpace(strings.TrimSuffix(value, ","))
+		if strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") && len(value) >= 2 {
+			recovered[m.name] = value[1 : len(value)-1]
+			continue
+		}
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return errors.New("cannot read value of field " + m.name)
+		}
+		recovered[m.name] = number
+	}
+	recoveredAsBytes, _ := json.Marshal(recovered)
+	return json.Unmarshal(recoveredAsBytes, target)
+}
+
+// ============================================================================================================================
+// sanitizeArgs - reject text that cannot be stored and read back unchanged: invalid UTF-8 is silently replaced by
+// the JSON encoder and control characters other than tab and newline have no business in a booking field
+// ============================================================================================================================
+func sanitizeArgs(args []string) error {
+	for i, arg := range args {
+		if !utf8.ValidString(arg) {
+			return newError(ERR_INVALID_ARGUMENT, "Argument " + strconv.Itoa(i) + " is not valid UTF-8")
+		}
+		for _, r := range arg {
+			if unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r' {
+				return newError(ERR_INVALID_ARGUMENT, "Argument " + strconv.Itoa(i) + " contains a control character")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var BerthHistoryPrefix = "_BerthHistory_" //prefix for the key/value that will store the status timeline of one booking
+
+var HISTORY_DELETED = "Deleted" // last entry of the timeline of a deleted booking, not a booking status
+
+type StatusChange struct { // One entry of a booking's status timeline
+	OldStatus   string `json:"oldStatus"`
+	NewStatus   string `json:"newStatus"`
+	Actor       string `json:"actor"`
+	TxID        string `json:"txID"`
+	TxTimestamp string `json:"txTimestamp"` // RFC3339, taken from the transaction not the peer clock
+	Reason      string `json:"reason"`
+	ReasonCode  string `json:"reasonCode,omitempty"` // catalogue code of a rejection or cancellation
+}
+
+// ============================================================================================================================
+// txTimestamp - the transaction timestamp in RFC3339, identical on every peer
+// ============================================================================================================================
+func txTimestamp(stub shim.ChaincodeStubInterface) (string, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return "", errors.New("Failed to get transaction timestamp")
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC().Format(time.RFC3339), nil
+}
+
+// ============================================================================================================================
+// appendStatusHistory - add a status change to the end of a booking's timeline, entries are never rewritten
+// ============================================================================================================================
+func appendStatusHistory(stub shim.ChaincodeStubInterface, bookingID string, oldStatus string, newStatus string, actor string, reason string, reasonCode string) error {
+	var history []StatusChange
+	historyAsBytes, err := stub.GetState(BerthHistoryPrefix + bookingID)
+	if err != nil {
+		return errors.New("Failed to get status history for " + bookingID)
+	}
+	json.Unmarshal(historyAsBytes, &history)
+	timestamp, err := txTimestamp(stub)
+	if err != nil {
+		return err
+	}
+	history = append(history, StatusChange{
+		OldStatus:   oldStatus,
+		NewStatus:   newStatus,
+		Actor:       actor,
+		TxID:        stub.GetTxID(),
+		TxTimestamp: timestamp,
+		Reason:      reason,
+		ReasonCode:  reasonCode,
+	})
+	jsonAsBytes, _ := json.Marshal(history)
+	return stub.PutState(BerthHistoryPrefix+bookingID, jsonAsBytes)
+}
+
+// ============================================================================================================================
+// getBerth_history - get the status timeline of a booking, oldest first. The timeline of a deleted booking is kept
+// and only admin may read it.
+// ============================================================================================================================
+func (t *ManageBerth) getBerth_history(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting ID of the booking to query")
+	}
+	fmt.Println("start getBerth_history")
+	bookingID := args[0]
+	res, err := getBerth(stub, bookingID)
+	if err != nil {
+		return nil, err
+	}
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	historyAsBytes, err := stub.GetState(BerthHistoryPrefix + bookingID)
+	if err != nil {
+		return nil, errors.New("Failed to get status history for " + bookingID)
+	}
+	if res == nil && (caller.Role != ROLE_ADMIN || historyAsBytes == nil) {
+		return nil, newError(ERR_NOT_FOUND, "Booking "+bookingID+" not found")
+	}
+	if res != nil {
+		err = checkBookingAccess(caller, *res)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if historyAsBytes == nil {
+		historyAsBytes = []byte("[]")
+	}
+	fmt.Println("end getBerth_history")
+	return historyAsBytes, nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Secondary indexes are stored as composite keys
+//	_BerthIdx <sep> index name <sep> field value <sep> booking ID
+// so every booking with a given value sits in one contiguous key range. The separator is U+0000, which
+// sanitizeArgs keeps out of every stored field.
+var BookingIndexPrefix = "_BerthIdx"
+var IndexSeparator = "\x00"
+
+type bookingFieldIndex struct { // A secondary index over one booking field
+	name  string
+	field func(Berth) string
+}
+
+var bookingIndexes = []bookingFieldIndex{
+	{"all", func(res Berth) string { return "*" }},		// every booking, for listings
+	{"vessel", func(res Berth) string { return res.VesselID }},
+	{"toID", func(res Berth) string { return res.TOID }},
+	{"agent", func(res Berth) string { return res.AgentRefNumber }},
+	{"approver", func(res Berth) string { return res.ApproverID }},
+	{"owner", func(res Berth) string { return res.OwnerName }},
+	{"allocatedBerth", func(res Berth) string { return res.AllocatedBerth }},
+}
+
+// ============================================================================================================================
+// bookingIndexPrefix - start of the key range holding every booking with the given value in an index
+// ============================================================================================================================
+func bookingIndexPrefix(name string, value string) string {
+	return BookingIndexPrefix + IndexSeparator + name + IndexSeparator + value + IndexSeparator
+}
+
+// ============================================================================================================================
+// updateBookingIndexes - move a booking's index entries from its old field values to its new ones, either side may be nil
+// ============================================================================================================================
+func updateBookingIndexes(stub shim.ChaincodeStubInterface, old *Berth, res *Berth) error {
+	for _, index := range bookingIndexes {
+		oldValue, newValue := "", ""
+		if old != nil {
+			oldValue = index.field(*old)
+		}
+		if res != nil {
+			newValue = index.field(*res)
+		}
+		if old != nil && res != nil && oldValue == newValue && old.BookingID == res.BookingID {
+			continue
+		}
+		if old != nil && oldValue != "" {
+			err := stub.DelState(bookingIndexPrefix(index.name, oldValue) + old.BookingID)
+			if err != nil {
+				return errors.New("Failed to remove " + index.name + " index entry for " + old.BookingID)
+			}
+		}
+		if res != nil && newValue != "" {
+			err := stub.PutState(bookingIndexPrefix(index.name, newValue)+res.BookingID, []byte(res.BookingID))
+			if err != nil {
+				return errors.New("Failed to write " + index.name + " index entry for " + res.BookingID)
+			}
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// lookupBookingIndex - get the booking IDs recorded under a value of an index, in key order
+// ============================================================================================================================
+func lookupBookingIndex(stub shim.ChaincodeStubInterface, name string, value string) ([]string, error) {
+	prefix := bookingIndexPrefix(name, value)
+	keysIter, err := stub.RangeQueryState(prefix, prefix+string(utf8.MaxRune))
+	if err != nil {
+		return nil, errors.New("Failed to scan " + name + " index")
+	}
+	defer keysIter.Close()
+	bookingIDs := []string{}
+	for keysIter.HasNext() {
+		key, _, err := keysIter.Next()
+		if err != nil {
+			return nil, errors.New("Failed to scan " + name + " index")
+		}
+		bookingIDs = append(bookingIDs, key[len(prefix):])
+	}
+	return bookingIDs, nil
+}
+
+// ============================================================================================================================
+// getBerthIndex - get the keys of every booking in key order, including any still listed only in the legacy index
+// ============================================================================================================================
+func getBerthIndex(stub shim.ChaincodeStubInterface) ([]string, error) {
+	bookingIDs, err := lookupBookingIndex(stub, "all", "*")
+	if err != nil {
+		return nil, err
+	}
+	legacyIDs, err := getLegacyKeys(stub, BerthIndexStr)
+	if err != nil {
+		return nil, err
+	}
+	return mergeKeys(bookingIDs, legacyIDs), nil
+}
+
+// ============================================================================================================================
+// getLegacyKeys - read one of the JSON array index keys used before the composite key indexes
+// ============================================================================================================================
+func getLegacyKeys(stub shim.ChaincodeStubInterface, indexKey string) ([]string, error) {
+	var keys []string
+	keysAsBytes, err := stub.GetState(indexKey)
+	if err != nil {
+		return nil, errors.New("Failed to get index " + indexKey)
+	}
+	json.Unmarshal(keysAsBytes, &keys)
+	return keys, nil
+}
+
+// ============================================================================================================================
+// putLegacyKeys - write back a legacy JSON array index, dropping the key altogether once it is empty
+// ============================================================================================================================
+func putLegacyKeys(stub shim.ChaincodeStubInterface, indexKey string, keys []string) error {
+	if len(keys) == 0 {
+		return stub.DelState(indexKey)
+	}
+	jsonAsBytes, _ := json.Marshal(keys)
+	return stub.PutState(indexKey, jsonAsBytes)
+}
+
+// ============================================================================================================================
+// removeLegacyBookingKeys - drop a deleted booking from the legacy index arrays, without writing them unless it is listed
+// ============================================================================================================================
+func removeLegacyBookingKeys(stub shim.ChaincodeStubInterface, vesselID string, bookingID string) error {
+	indexKeys := []string{BerthIndexStr}
+	if vesselID != "" {
+		indexKeys = append(indexKeys, VesselBookingsPrefix+vesselID)
+	}
+	for _, indexKey := range indexKeys {
+		keys, err := getLegacyKeys(stub, indexKey)
+		if err != nil {
+			return err
+		}
+		for i, key := range keys {
+			if key == bookingID {
+				err = putLegacyKeys(stub, indexKey, append(keys[:i], keys[i+1:]...))
+				if err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// mergeKeys - union of two key lists, sorted and without duplicates
+// ============================================================================================================================
+func mergeKeys(a []string, b []string) []string {
+	seen := make(map[string]bool)
+	keys := []string{}
+	for _, key := range append(append([]string{}, a...), b...) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ============================================================================================================================
+// migrate_berth_index - one-off move from the shared JSON array indexes to per-booking index keys. Bookings that
+// cannot be read or are still keyed by vesselID stay in the legacy index for repair_berth_records and
+// migrate_berth_bookingIDs; run this again once they are fixed. Bookings already moved are indexed again, so running
+// it after an index is added fills that index.
+// ============================================================================================================================
+func (t *ManageBerth) migrate_berth_index(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("start migrate_berth_index")
+	legacyIDs, err := getLegacyKeys(stub, BerthIndexStr)
+	if err != nil {
+		return nil, err
+	}
+	indexedIDs, err := lookupBookingIndex(stub, "all", "*")
+	if err != nil {
+		return nil, err
+	}
+	reindexed := []string{}
+	for _, key := range indexedIDs {
+		res, err := getBerth(stub, key)
+		if err != nil || res == nil || res.BookingID != key {
+			continue
+		}
+		err = updateBookingIndexes(stub, nil, res)
+		if err != nil {
+			return nil, err
+		}
+		reindexed = append(reindexed, key)
+	}
+	migrated, kept := []string{}, []string{}
+	isMigrated := make(map[string]bool)
+	vessels := make(map[string]bool)
+	for _, key := range legacyIDs {
+		res, err := getBerth(stub, key)
+		if err == nil && res == nil {									//deleted long ago, nothing to index
+			continue
+		}
+		if err != nil || res.BookingID != key {
+			kept = append(kept, key)
+			continue
+		}
+		err = updateBookingIndexes(stub, nil, res)
+		if err != nil {
+			return nil, err
+		}
+		migrated = append(migrated, key)
+		isMigrated[key] = true
+		vessels[res.VesselID] = true
+	}
+	for vesselID := range vessels {
+		bookingIDs, err := getLegacyKeys(stub, VesselBookingsPrefix+vesselID)
+		if err != nil {
+			return nil, err
+		}
+		remaining := []string{}
+		for _, bookingID := range bookingIDs {
+			if !isMigrated[bookingID] {
+				remaining = append(remaining, bookingID)
+			}
+		}
+		err = putLegacyKeys(stub, VesselBookingsPrefix+vesselID, remaining)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = putLegacyKeys(stub, BerthIndexStr, kept)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.DelState(BerthMasterIndexStr)							//berth masters are listed by key prefix now
+	if err != nil {
+		return nil, err
+	}
+	report, _ := json.Marshal(map[string][]string{"migrated": migrated, "kept": kept, "reindexed": reindexed})
+	fmt.Println("end migrate_berth_index")
+	return report, nil
+}
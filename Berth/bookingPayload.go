@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Positional order of the create_berth and update_berth arguments, the JSON payload is flattened into these
+var createBookingOrder = []string{"vesselID", "vesselName", "vesselType", "vesselClass", "agentRefNumber", "arrivalPort", "inboundVoyageNo", "outboundVoyageNo", "arriveFrom", "terminal", "remarks", "rotationNumber", "toID", "approverID", "mmsiNumber", "portOfRegisteration", "ownerName", "ownerPhoneNumber", "preferredBerth", "requestedETB", "requestedETD"}
+var updateBookingOrder = []string{"bookingID", "vesselName", "vesselType", "vesselClass", "agentRefNumber", "arrivalPort", "inboundVoyageNo", "outboundVoyageNo", "arriveFrom", "terminal", "remarks", "rotationNumber", "toID", "approverID", "mmsiNumber", "portOfRegisteration", "ownerName", "ownerPhoneNumber", "preferredBerth", "allocatedBerth", "requestedETB", "requestedETD", "allocatedETB", "allocatedETD"}
+
+// Schema of a booking payload
+var bookingSchema = map[string]fieldRule{
+	"bookingID":           {Required: true, Format: FORMAT_TEXT},
+	"vesselID":            {Required: true, Format: FORMAT_TEXT},
+	"vesselName":          {Required: true, Format: FORMAT_TEXT},
+	"vesselType":          {Required: true, Format: FORMAT_TEXT, Enum: VesselTypes},
+	"vesselClass":         {Format: FORMAT_TEXT},
+	"agentRefNumber":      {Required: true, Format: FORMAT_TEXT},
+	"arrivalPort":         {Required: true, Format: FORMAT_TEXT},
+	"inboundVoyageNo":     {Format: FORMAT_TEXT},
+	"outboundVoyageNo":    {Format: FORMAT_TEXT},
+	"arriveFrom":          {Format: FORMAT_TEXT},
+	"terminal":            {Required: true, Format: FORMAT_TEXT},
+	"remarks":             {Format: FORMAT_TEXT},
+	"rotationNumber":      {Required: true, Format: FORMAT_TEXT},
+	"toID":                {Format: FORMAT_TEXT},
+	"approverID":          {Format: FORMAT_TEXT},
+	"mmsiNumber":          {Format: FORMAT_MMSI},
+	"portOfRegisteration": {Format: FORMAT_TEXT},
+	"ownerName":           {Format: FORMAT_TEXT},
+	"ownerPhoneNumber":    {Format: FORMAT_TEXT},
+	"preferredBerth":      {Format: FORMAT_TEXT},
+	"allocatedBerth":      {Format: FORMAT_TEXT},
+	"requestedETB":        {Required: true, Format: FORMAT_RFC3339},
+	"requestedETD":        {Required: true, Format: FORMAT_RFC3339},
+	"allocatedETB":        {Format: FORMAT_RFC3339},
+	"allocatedETD":        {Format: FORMAT_RFC3339},
+}
+
+// Formats understood by the payload schema
+var FORMAT_TEXT = "text"
+var FORMAT_RFC3339 = "rfc3339"
+var FORMAT_NUMBER = "number"     // JSON number, zero or more
+var FORMAT_POSITIVE = "positive" // JSON number, more than zero
+var FORMAT_MMSI = "mmsi"         // nine digits
+
+// Vessel types accepted by the JSON payloads
+var VesselTypes = []string{"Container", "Bulk Carrier", "Tanker", "General Cargo", "RoRo", "Passenger", "LNG Carrier", "LPG Carrier", "Reefer", "Offshore", "Tug", "Other"}
+
+type fieldRule struct { // Declared constraints of one payload field
+	Required bool
+	Format   string
+	Enum     []string
+}
+
+type FieldError struct { // Why one payload field was refused
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ============================================================================================================================
+// checkField - validate one decoded JSON value against its rule, returns "" when the value is acceptable
+// ============================================================================================================================
+func checkField(rule fieldRule, value interface{}, present bool) string {
+	if !present || value == nil {
+		if rule.Required {
+			return "is required"
+		}
+		return ""
+	}
+	if rule.Format == FORMAT_NUMBER || rule.Format == FORMAT_POSITIVE {
+		number, ok := value.(json.Number)
+		if !ok {
+			return "must be a JSON number"
+		}
+		parsed, err := number.Float64()
+		if err != nil || parsed < 0 {
+			return "must be zero or more"
+		}
+		if rule.Format == FORMAT_POSITIVE && parsed == 0 {
+			return "must be greater than zero"
+		}
+		return ""
+	}
+	text, ok := value.(string)
+	if !ok {
+		return "must be a JSON string"
+	}
+	if strings.TrimSpace(text) == "" {
+		if rule.Required {
+			return "is required"
+		}
+		return ""
+	}
+	if rule.Format == FORMAT_RFC3339 {
+		if _, err := time.Parse(time.RFC3339, text); err != nil {
+			return "must be an RFC3339 timestamp"
+		}
+	}
+	if rule.Format == FORMAT_MMSI {
+		if len(text) != 9 || strings.Trim(text, "0123456789") != "" {
+			return "must be nine digits"
+		}
+	}
+	if len(rule.Enum) > 0 {
+		for _, allowed := range rule.Enum {
+			if text == allowed {
+				return ""
+			}
+		}
+		return "must be one of: " + strings.Join(rule.Enum, ", ")
+	}
+	return ""
+}
+
+// ============================================================================================================================
+// payloadToArgs - validate a JSON document against a schema and flatten it into the positional argument order,
+// every problem is reported at once as a field-by-field list
+// ============================================================================================================================
+func payloadToArgs(payload string, order []string, rules map[string]fieldRule) ([]string, error) {
+	decoder := json.NewDecoder(strings.NewReader(payload))
+	decoder.UseNumber()
+	var document map[string]interface{}
+	err := decoder.Decode(&document)
+	if err != nil || document == nil {
+		return nil, newError(ERR_INVALID_ARGUMENT, "Payload must be a single JSON object")
+	}
+
+	fieldErrors := []FieldError{}
+	allowed := make(map[string]bool)
+	for _, name := range order {
+		allowed[name] = true
+	}
+	unknown := []string{}
+	for name := range document {
+		if !allowed[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		fieldErrors = append(fieldErrors, FieldError{name, "is not a known field"})
+	}
+
+	args := make([]string, len(order))
+	for i, name := range order {
+		value, present := document[name]
+		message := checkField(rules[name], value, present)
+		if message != "" {
+			fieldErrors = append(fieldErrors, FieldError{name, message})
+			continue
+		}
+		switch typed := value.(type) {
+		case string:
+			args[i] = typed
+		case json.Number:
+			args[i] = typed.String()
+		}
+	}
+	if len(fieldErrors) > 0 {
+		return nil, &ChaincodeError{ResponseError{Code: ERR_INVALID_ARGUMENT, Message: "Invalid payload", Field: fieldErrors[0].Field, Details: fieldErrors}}
+	}
+	return args, nil
+}
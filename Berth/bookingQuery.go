@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+type BookingFilter struct { // A condition on one booking field, or an and/or of nested filters
+	And   []BookingFilter `json:"and,omitempty"`
+	Or    []BookingFilter `json:"or,omitempty"`
+	Field string          `json:"field,omitempty"` // JSON name of a booking field, e.g. berthBookingStatus
+	Eq    *string         `json:"eq,omitempty"`
+	In    []string        `json:"in,omitempty"`
+	From  string          `json:"from,omitempty"` // inclusive, timestamps are compared as times
+	To    string          `json:"to,omitempty"`   // inclusive
+}
+
+type BookingSort struct {
+	Field string `json:"field"`
+	Desc  bool   `json:"desc"`
+}
+
+type BookingQuery struct { // Argument of query_bookings
+	Filter   *BookingFilter `json:"filter"`
+	Sort     []BookingSort  `json:"sort"`
+	PageSize int            `json:"pageSize"`
+	Bookmark string         `json:"bookmark"`
+}
+
+// bookingFields maps the JSON name of every booking field to its position in the Berth struct
+var bookingFields = func() map[string]int {
+	fields := make(map[string]int)
+	berthType := reflect.TypeOf(Berth{})
+	for i := 0; i < berthType.NumField(); i++ {
+		fields[strings.Split(berthType.Field(i).Tag.Get("json"), ",")[0]] = i
+	}
+	return fields
+}()
+
+// indexedFields names the secondary index that can answer an equality condition on a booking field
+var indexedFields = map[string]string{
+	"vesselID":       "vessel",
+	"toID":           "toID",
+	"agentRefNumber": "agent",
+	"approverID":     "approver",
+	"ownerName":      "owner",
+	"allocatedBerth": "allocatedBerth",
+}
+
+// ============================================================================================================================
+// bookingFieldValue - value of a booking field by its JSON name
+// ============================================================================================================================
+func bookingFieldValue(res Berth, field string) string {
+	return reflect.ValueOf(res).Field(bookingFields[field]).String()
+}
+
+// ============================================================================================================================
+// compareValues - order two field values, as times when both are RFC3339 timestamps and as text otherwise
+// ============================================================================================================================
+func compareValues(a string, b string) int {
+	timeA, errA := time.Parse(time.RFC3339, a)
+	timeB, errB := time.Parse(time.RFC3339, b)
+	if errA == nil && errB == nil {
+		if timeA.Before(timeB) {
+			return -1
+		}
+		if timeA.After(timeB) {
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+// ============================================================================================================================
+// check - reject filters that name unknown fields or mix condition kinds
+// ============================================================================================================================
+func (f BookingFilter) check() error {
+	kinds := 0
+	if len(f.And) > 0 {
+		kinds++
+	}
+	if len(f.Or) > 0 {
+		kinds++
+	}
+	if f.Field != "" {
+		kinds++
+	}
+	if kinds != 1 {
+		return newError(ERR_INVALID_ARGUMENT, "Each filter needs exactly one of and, or, field")
+	}
+	for _, nested := range append(append([]BookingFilter{}, f.And...), f.Or...) {
+		err := nested.check()
+		if err != nil {
+			return err
+		}
+	}
+	if f.Field == "" {
+		return nil
+	}
+	if _, ok := bookingFields[f.Field]; !ok {
+		return newError(ERR_INVALID_ARGUMENT, "Unknown booking field '" + f.Field + "'")
+	}
+	if f.Eq == nil && len(f.In) == 0 && f.From == "" && f.To == "" {
+		return newError(ERR_INVALID_ARGUMENT, "Condition on '" + f.Field + "' needs eq, in, from or to")
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// matches - does a booking satisfy the filter
+// ============================================================================================================================
+func (f BookingFilter) matches(res Berth) bool {
+	for _, nested := range f.And {
+		if !nested.matches(res) {
+			return false
+		}
+	}
+	if len(f.Or) > 0 {
+		found := false
+		for _, nested := range f.Or {
+			if nested.matches(res) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Field == "" {
+		return true
+	}
+	value := bookingFieldValue(res, f.Field)
+	if f.Eq != nil && value != *f.Eq {
+		return false
+	}
+	if len(f.In) > 0 {
+		found := false
+		for _, candidate := range f.In {
+			if value == candidate {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.From != "" && compareValues(value, f.From) < 0 {
+		return false
+	}
+	if f.To != "" && compareValues(value, f.To) > 0 {
+		return false
+	}
+	return true
+}
+
+// ============================================================================================================================
+// indexHint - an equality condition every match must satisfy that a secondary index can answer
+// ============================================================================================================================
+func (f BookingFilter) indexHint() (string, string, bool) {
+	if f.Field != "" && f.Eq != nil && *f.Eq != "" {
+		index, ok := indexedFields[f.Field]
+		return index, *f.Eq, ok
+	}
+	for _, nested := range f.And {
+		index, value, ok := nested.indexHint()
+		if ok {
+			return index, value, ok
+		}
+	}
+	return "", "", false
+}
+
+// bookingSorter orders bookings by a list of fields, booking ID breaks ties
+type bookingSorter struct {
+	records []Berth
+	sorts   []BookingSort
+}
+
+func (s bookingSorter) Len() int      { return len(s.records) }
+func (s bookingSorter) Swap(i, j int) { s.records[i], s.records[j] = s.records[j], s.records[i] }
+func (s bookingSorter) Less(i, j int) bool {
+	for _, order := range s.sorts {
+		c := compareValues(bookingFieldValue(s.records[i], order.Field), bookingFieldValue(s.records[j], order.Field))
+		if c != 0 {
+			return (c < 0) != order.Desc
+		}
+	}
+	return s.records[i].BookingID < s.records[j].BookingID
+}
+
+// ============================================================================================================================
+// findBookings - every booking the caller may see matching a filter, sorted. An equality condition on an indexed field narrows the scan
+// to that index and to bookings not yet moved off the legacy index, otherwise every booking is read.
+// ============================================================================================================================
+func findBookings(stub shim.ChaincodeStubInterface, filter *BookingFilter, sorts []BookingSort) ([]Berth, error) {
+	if filter != nil {
+		err := filter.check()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, order := range sorts {
+		if _, ok := bookingFields[order.Field]; !ok {
+			return nil, newError(ERR_INVALID_ARGUMENT, "Unknown booking field '" + order.Field + "' in sort")
+		}
+	}
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	if scope := caller.bookingScope(); scope != nil {
+		scoped := BookingFilter{And: []BookingFilter{*scope}}
+		if filter != nil {
+			scoped.And = append(scoped.And, *filter)
+		}
+		filter = &scoped
+	}
+	var keys []string
+	if filter != nil {
+		if index, value, ok := filter.indexHint(); ok {
+			var legacyIDs []string
+			keys, err = lookupBookingIndex(stub, index, value)
+			if err == nil {
+				legacyIDs, err = getLegacyKeys(stub, BerthIndexStr)
+				keys = mergeKeys(keys, legacyIDs)
+			}
+		}
+	}
+	if keys == nil && err == nil {
+		keys, err = getBerthIndex(stub)
+	}
+	if err != nil {
+		return nil, err
+	}
+	records := []Berth{}
+	for _, key := range keys {
+		res, err := getBerth(stub, key)
+		if err != nil {
+			fmt.Println("skipping booking " + key + ": " + err.Error())
+			continue
+		}
+		if res != nil && (filter == nil || filter.matches(*res)) {
+			records = append(records, *res)
+		}
+	}
+	sort.Sort(bookingSorter{records, sorts})
+	return records, nil
+}
+
+// ============================================================================================================================
+// bookingsByID - the historic getBerth_by* answer, a JSON object of bookings keyed by booking ID
+// ============================================================================================================================
+func bookingsByID(records []Berth) ([]byte, error) {
+	bookings := make(map[string]Berth)
+	for _, res := range records {
+		bookings[res.BookingID] = res
+	}
+	return json.Marshal(bookings)
+}
+
+// ============================================================================================================================
+// findBookingsByField - bookings whose field equals a value, keyed by booking ID
+// ============================================================================================================================
+func findBookingsByField(stub shim.ChaincodeStubInterface, field string, value string) ([]byte, error) {
+	records, err := findBookings(stub, &BookingFilter{Field: field, Eq: &value}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return bookingsByID(records)
+}
+
+// ============================================================================================================================
+// query_bookings - filter, sort and page through bookings. The argument is a JSON document such as
+//	{"filter": {"and": [{"field": "berthBookingStatus", "in": ["New", "In Progress"]},
+//	                    {"field": "requestedETB", "from": "2017-03-01T00:00:00Z", "to": "2017-03-31T23:59:59Z"}]},
+//	 "sort": [{"field": "requestedETB"}], "pageSize": 20, "bookmark": ""}
+// and the answer is one page of matching bookings with the total number of matches.
+// ============================================================================================================================
+func (t *ManageBerth) query_bookings(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting a JSON query document")
+	}
+	fmt.Println("start query_bookings")
+	query := BookingQuery{}
+	err := json.Unmarshal([]byte(args[0]), &query)
+	if err != nil {
+		return nil, newError(ERR_INVALID_ARGUMENT, "Query must be a JSON document with filter, sort, pageSize and bookmark: " + err.Error())
+	}
+	if query.PageSize == 0 {
+		query.PageSize = DefaultPageSize
+	}
+	if query.PageSize < 1 || query.PageSize > MaxPageSize {
+		return nil, newError(ERR_INVALID_ARGUMENT, "Page size must be a number from 1 to " + strconv.Itoa(MaxPageSize))
+	}
+	offset := 0
+	if query.Bookmark != "" {
+		offset, err = strconv.Atoi(query.Bookmark)
+		if err != nil || offset < 0 {
+			return nil, newError(ERR_INVALID_ARGUMENT, "Bookmark must be the value returned with the previous page")
+		}
+	}
+	records, err := findBookings(stub, query.Filter, query.Sort)
+	if err != nil {
+		return nil, err
+	}
+	page := BerthPage{Records: []Berth{}, TotalCount: len(records)}
+	if offset < len(records) {
+		end := offset + query.PageSize
+		if end < len(records) {
+			page.Bookmark = strconv.Itoa(end)
+		} else {
+			end = len(records)
+		}
+		page.Records = records[offset:end]
+	}
+	page.Count = len(page.Records)
+	fmt.Println("end query_bookings")
+	return json.Marshal(page)
+}
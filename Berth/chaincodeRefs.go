@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos"
+)
+
+var ChaincodeRefsKey = "_ChaincodeRefs" //key of the Allocation chaincode booking status changes come through
+
+type ChaincodeRefs struct { // The chaincode trusted to run the allocation workflows
+	AllocationChaincode string `json:"allocationChaincode"`
+	LastModifiedBy      string `json:"lastModifiedBy"` // signer of the latest change, empty when set at deployment
+	LastModifiedAt      string `json:"lastModifiedAt"`
+}
+
+// ============================================================================================================================
+// allocationChaincode - the Allocation chaincode whose workflows move bookings, never taken from the caller
+// ============================================================================================================================
+func allocationChaincode(stub shim.ChaincodeStubInterface) (string, error) {
+	refsAsBytes, err := stub.GetState(ChaincodeRefsKey)
+	if err != nil {
+		return "", errors.New("Failed to get the chaincode references")
+	}
+	refs := ChaincodeRefs{}
+	json.Unmarshal(refsAsBytes, &refs)
+	if refs.AllocationChaincode == "" {
+		return "", newError(ERR_CONFLICT, "The Allocation chaincode is not configured, call set_chaincode_references")
+	}
+	return refs.AllocationChaincode, nil
+}
+
+// ============================================================================================================================
+// submittedTo - was the transaction sent by the client to the named chaincode. A chaincode called by another one is
+// handed the payload of the transaction the client signed, the invocation of the outermost chaincode.
+// ============================================================================================================================
+func submittedTo(stub shim.ChaincodeStubInterface, chaincodeName string) bool {
+	payload, err := stub.GetPayload()
+	if err != nil || len(payload) == 0 {
+		return false
+	}
+	spec := &protos.ChaincodeInvocationSpec{}
+	if proto.Unmarshal(payload, spec) != nil {
+		return false
+	}
+	return spec.ChaincodeSpec != nil && spec.ChaincodeSpec.ChaincodeID != nil && spec.ChaincodeSpec.ChaincodeID.Name == chaincodeName
+}
+
+// ============================================================================================================================
+// checkWorkflowCall - booking statuses are changed by the Allocation workflows, which move the vessel and record the
+// allocation in the same transaction. Only admin may call in directly, to repair a booking.
+// ============================================================================================================================
+func checkWorkflowCall(stub shim.ChaincodeStubInterface, caller Caller) error {
+	if caller.Role == ROLE_ADMIN {
+		return nil
+	}
+	AllocationChaincode, err := allocationChaincode(stub)
+	if err != nil {
+		return err
+	}
+	if !submittedTo(stub, AllocationChaincode) {
+		return newError(ERR_FORBIDDEN, "Booking statuses are changed through the Allocation chaincode")
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// putAllocationChaincode - store the Allocation chaincode reference, stamped with the signer when there is one
+// ============================================================================================================================
+func putAllocationChaincode(stub shim.ChaincodeStubInterface, name string, actor *Actor) error {
+	refs := ChaincodeRefs{AllocationChaincode: strings.TrimSpace(name)}
+	if refs.AllocationChaincode == "" {
+		return fieldError("allocationChaincode", "Allocation chaincode must not be empty")
+	}
+	if actor != nil {
+		refs.LastModifiedBy = actor.ID()
+		refs.LastModifiedAt = actor.Time
+	}
+	refsAsBytes, _ := json.Marshal(refs)
+	return stub.PutState(ChaincodeRefsKey, refsAsBytes)
+}
+
+// ============================================================================================================================
+// set_chaincode_references - name the Allocation chaincode booking status changes come through. The Allocation
+// chaincode is deployed after this one and with its name, so the reference is usually set here once it is known.
+// ============================================================================================================================
+func (t *ManageBerth) set_chaincode_references(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting AllocationChaincode")
+	}
+	fmt.Println("start set_chaincode_references")
+	actor, err := getActor(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = putAllocationChaincode(stub, args[0], &actor)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("end set_chaincode_references")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// get_chaincode_references - get the Allocation chaincode booking status changes come through
+// ============================================================================================================================
+func (t *ManageBerth) get_chaincode_references(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	refsAsBytes, err := stub.GetState(ChaincodeRefsKey)
+	if err != nil {
+		return nil, errors.New("Failed to get the chaincode references")
+	}
+	if refsAsBytes == nil {
+		return nil, newError(ERR_NOT_FOUND, "The Allocation chaincode is not configured")
+	}
+	return refsAsBytes, nil
+}
@@ -20,7 +20,9 @@ package main
 import (
 "errors"
 "fmt"
-"strconv"
+"sort"
+"strings"
+"time"
 "encoding/json"
 
 "github.com/hyperledger/fabric/core/chaincode/shim"
@@ -32,9 +34,11 @@ var EVENT_COUNTER = "event_counter"
 type ManageBerth struct {
 }
 
-var BerthIndexStr = "_Berthindex"				//name for the key/value that will store a list of all known Berth
+var BerthIndexStr = "_Berthindex"				//legacy list of all known Berth, replaced by per-booking index keys
+var VesselBookingsPrefix = "_VesselBookings_"		//legacy per-vessel list of booking IDs, replaced by the vessel index
 
 type Berth struct{							// Attributes of a Berth 				
+	BookingID string `json:"bookingID"`				// port call key, vesselID + "-" + rotationNumber
 	VesselID string `json:"vesselID"`
 	VesselName string `json:"vesselName"`					
 	VesselType string `json:"vesselType"`
@@ -56,9 +60,36 @@ type Berth struct{							// Attributes of a Berth
 	OwnerPhoneNumber string `json:"ownerPhoneNumber"`
 	PreferredBerth string `json:"preferredBerth"`
 	AllocatedBerth string `json:"allocatedBerth"`
+	RequestedETB string `json:"requestedETB"`				// requested berthing window, RFC3339
+	RequestedETD string `json:"requestedETD"`
+	AllocatedETB string `json:"allocatedETB"`				// allocated berthing window, RFC3339
+	AllocatedETD string `json:"allocatedETD"`
+	TODecision string `json:"toDecision"`				// Confirmed or Declined by the terminal operator, TOID signed it
+	TODecisionAt string `json:"toDecisionAt"`
+	TORemarks string `json:"toRemarks"`
+	PADecision string `json:"paDecision"`				// Approved or Rejected by the port authority, ApproverID signed it
+	PADecisionAt string `json:"paDecisionAt"`
+	PARemarks string `json:"paRemarks"`
+	ReasonCode string `json:"reasonCode"`				// why the booking was rejected or cancelled, from the reason code catalogue
+	ReasonRemarks string `json:"reasonRemarks"`
+	CreatedBy string `json:"createdBy"`				// signer of the creating transaction, MSP ID / certificate subject
+	CreatedAt string `json:"createdAt"`				// transaction timestamp, RFC3339
+	LastModifiedBy string `json:"lastModifiedBy"`		// signer of the latest change
+	LastModifiedAt string `json:"lastModifiedAt"`
 	
 }
 
+type BerthOccupancy struct{						// The window a booking takes a berth for, readable by every role
+	BookingID string `json:"bookingID"`
+	RotationNumber string `json:"rotationNumber"`
+	AllocatedBerth string `json:"allocatedBerth"`
+	AllocatedETB string `json:"allocatedETB"`
+	AllocatedETD string `json:"allocatedETD"`
+	RequestedETB string `json:"requestedETB"`
+	RequestedETD string `json:"requestedETD"`
+	BerthBookingStatus string `json:"berthBookingStatus"`
+}
+
 
 // ============================================================================================================================
 // Main - start the chaincode for Berth management
@@ -70,13 +101,25 @@ func main() {
 	}
 }
 // ============================================================================================================================
-// Init - reset all the things
+// Init - entry point, the answer or failure is wrapped in the response envelope
 // ============================================================================================================================
 func (t *ManageBerth) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	return respond(t.initChaincode(stub, function, args))
+}
+// ============================================================================================================================
+// initChaincode - reset all the things, the Allocation chaincode may be named when it is already known
+// ============================================================================================================================
+func (t *ManageBerth) initChaincode(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	var msg string
 	var err error
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 and optional AllocationChaincode")
+	}
+	if len(args) == 2 {
+		err = putAllocationChaincode(stub, args[1], nil)
+		if err != nil {
+			return nil, err
+		}
 	}
 	// Initialize the chaincode
 	msg = args[0]
@@ -88,12 +131,6 @@ func (t *ManageBerth) Init(stub shim.ChaincodeStubInterface, function string, ar
 		return nil, err
 	}
 	
-	var empty []string
-	jsonAsBytes, _ := json.Marshal(empty)								//marshal an emtpy array of strings to clear the index
-	err = stub.PutState(BerthIndexStr, jsonAsBytes)
-	if err != nil {
-		return nil, err
-	}
 	err = stub.PutState(EVENT_COUNTER, []byte("1"))
 	if err != nil {
 		return nil, err
@@ -108,14 +145,24 @@ func (t *ManageBerth) Init(stub shim.ChaincodeStubInterface, function string, ar
 		return t.Invoke(stub, function, args)
 	}
 // ============================================================================================================================
-// Invoke - Our entry point for Invocations
+// Invoke - entry point, the answer or failure is wrapped in the response envelope
+// ============================================================================================================================
+func (t *ManageBerth) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	return respond(t.invokeFunction(stub, function, args))
+}
+// ============================================================================================================================
+// invokeFunction - run an invocation
 // ============================================================================================================================
-	func (t *ManageBerth) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	func (t *ManageBerth) invokeFunction(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 		fmt.Println("invoke is running " + function)
+	err := authorize(stub, function)
+	if err != nil {
+		return nil, err
+	}
 
 	// Handle different functions
 	if function == "init" {													//initialize the chaincode state, used as reset
-		return t.Init(stub, "init", args)
+		return t.initChaincode(stub, "init", args)
 	} else if function == "create_berth" {											//create a new Berth
 		return t.create_berth(stub, args)
 	}else if function == "delete_berth" {									// delete a Berth
@@ -124,18 +171,52 @@ func (t *ManageBerth) Init(stub shim.ChaincodeStubInterface, function string, ar
 		return t.update_berth(stub, args)
 	}else if function == "update_berth_allocationStatus" {									//update a Berth
 		return t.update_berth_allocationStatus(stub, args)
+	}else if function == "update_berth_allocation" {									//set the allocated berth and window
+		return t.update_berth_allocation(stub, args)
+	}else if function == "migrate_berth_bookingIDs" {									//re-key bookings stored by vesselID
+		return t.migrate_berth_bookingIDs(stub, args)
+	}else if function == "create_berth_master" {									//register a physical berth
+		return t.create_berth_master(stub, args)
+	}else if function == "update_berth_master" {									//update a physical berth
+		return t.update_berth_master(stub, args)
+	}else if function == "retire_berth_master" {									//take a physical berth out of service
+		return t.retire_berth_master(stub, args)
+	}else if function == "reactivate_berth_master" {									//put a retired berth back into service
+		return t.reactivate_berth_master(stub, args)
+	}else if function == "set_reason_code" {									//add or change a rejection or cancellation reason
+		return t.set_reason_code(stub, args)
+	}else if function == "retire_reason_code" {									//stop a reason code from being given
+		return t.retire_reason_code(stub, args)
+	}else if function == "repair_berth_records" {									//rewrite stored bookings as well formed JSON
+		return t.repair_berth_records(stub, args)
+	}else if function == "migrate_berth_index" {									//move listings off the shared index keys
+		return t.migrate_berth_index(stub, args)
+	}else if function == "set_chaincode_references" {									//name the Allocation chaincode running the workflows
+		return t.set_chaincode_references(stub, args)
 	}
 	fmt.Println("invoke did not find func: " + function)					//error
-	return nil, errors.New("Received unknown function invocation")
+	return nil, newError(ERR_INVALID_ARGUMENT, "Received unknown function invocation")
 }
 // ============================================================================================================================
-// Query - Our entry point for Queries
+// Query - entry point, the answer or failure is wrapped in the response envelope
 // ============================================================================================================================
 func (t *ManageBerth) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	return respond(t.queryFunction(stub, function, args))
+}
+// ============================================================================================================================
+// queryFunction - run a query
+// ============================================================================================================================
+func (t *ManageBerth) queryFunction(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	fmt.Println("query is running " + function)
+	err := authorize(stub, function)
+	if err != nil {
+		return nil, err
+	}
 
 	// Handle different functions
-	if function == "getBerth_byVesselID" {													//Read a Berth by transId
+	if function == "getBerth_byBookingID" {													//Read a Berth by booking ID
+		return t.getBerth_byBookingID(stub, args)
+	} else if function == "getBerth_byVesselID" {													//Read all Berths of a vessel
 		return t.getBerth_byVesselID(stub, args)
 	} else if function == "getBerth_byTO" {													//Read all Berths
 		return t.getBerth_byTO(stub, args)
@@ -145,314 +226,159 @@ func (t *ManageBerth) Query(stub shim.ChaincodeStubInterface, function string, a
 		return t.getBerth_bySA(stub, args)
 	} else if function == "getBerth_byPA" {													//Read all Berths
 		return t.getBerth_byPA(stub, args)
-	} else if function == "get_AllBerth" {													//Read all Berths
+	} else if function == "query_bookings" {													//Filter, sort and page through Berths
+		return t.query_bookings(stub, args)
+	} else if function == "get_AllBerth" {													//Read a page of all Berths
 		return t.get_AllBerth(stub, args)
+	} else if function == "getBerth_history" {													//Read the status timeline of a Berth
+		return t.getBerth_history(stub, args)
+	} else if function == "getBerth_byAllocatedBerth" {													//Read all bookings on a berth
+		return t.getBerth_byAllocatedBerth(stub, args)
+	} else if function == "getBerth_occupancy" {													//Read the windows a berth is taken for
+		return t.getBerth_occupancy(stub, args)
+	} else if function == "getBerthMaster_byCode" {													//Read a physical berth
+		return t.getBerthMaster_byCode(stub, args)
+	} else if function == "get_AllBerthMaster" {													//Read all physical berths
+		return t.get_AllBerthMaster(stub, args)
+	} else if function == "getReasonCode_byCode" {													//Read a rejection or cancellation reason
+		return t.getReasonCode_byCode(stub, args)
+	} else if function == "get_AllReasonCodes" {													//Read the reason code catalogue
+		return t.get_AllReasonCodes(stub, args)
+	} else if function == "validate_berth_records" {													//Report malformed stored bookings
+		return t.validate_berth_records(stub, args)
+	} else if function == "get_chaincode_references" {													//Read the Allocation chaincode in use
+		return t.get_chaincode_references(stub, args)
 	}
 	fmt.Println("query did not find func: " + function)						//error
-	return nil, errors.New("Received unknown function query")
+	return nil, newError(ERR_INVALID_ARGUMENT, "Received unknown function query")
 }
 // ============================================================================================================================
-// getBerth_byVesselID - get Berth details for a specific ID from chaincode state
+// getBerth_byBookingID - get Berth details for a specific booking ID from chaincode state
+// ============================================================================================================================
+func (t *ManageBerth) getBerth_byBookingID(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("start getBerth_byBookingID")
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting ID of the booking to query")
+	}
+	res, err := getBerth(stub, args[0])									//get the bookingID from chaincode state
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, newError(ERR_NOT_FOUND, "Booking " + args[0] + " not found")
+	}
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = checkBookingAccess(caller, *res)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("end getBerth_byBookingID")
+	return json.Marshal(res)												//send it onward
+}
+// ============================================================================================================================
+// getBerth_byVesselID - get all bookings of a specific vessel, keyed by booking ID
 // ============================================================================================================================
 func (t *ManageBerth) getBerth_byVesselID(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var vesselID, jsonResp string
-	var err error
 	fmt.Println("start getBerth_byVesselID")
 	if len(args) != 1 {
 		return nil, errors.New("Incorrect number of arguments. Expecting ID of the vessel to query")
 	}
-	// set berthID
-	vesselID = args[0]
-	valAsbytes, err := stub.GetState(vesselID)									//get the vesselID from chaincode state
-	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + vesselID + "\"}"
-		return nil, errors.New(jsonResp)
-	}
-	//fmt.Print("valAsbytes : ")
-	//fmt.Println(valAsbytes)
 	fmt.Println("end getBerth_byVesselID")
-	return valAsbytes, nil													//send it onward
+	return findBookingsByField(stub, "vesselID", args[0])
 }
 // ============================================================================================================================
-// getBerth_byTO - get Berth details for a specific ID from chaincode state
+// getBerth_byTO - get all bookings handled by a terminal operator
 // ============================================================================================================================
 func (t *ManageBerth) getBerth_byTO(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var jsonResp, toID, errResp string
-	var berthIndex []string
-	var valIndex Berth
 	fmt.Println("start getBerth_byTO")
-	var err error
 	if len(args) != 1 {
 		return nil, errors.New("Incorrect number of arguments. Expecting 1 argument")
 	}
-	// set buyer's name
-	toID = args[0]
-	//fmt.Println("buyerName" + buyerName)
-	berthAsBytes, err := stub.GetState(BerthIndexStr)
-	if err != nil {
-		return nil, errors.New("Failed to get Berth index string")
-	}
-	//fmt.Print("poAsBytes : ")
-	//fmt.Println(poAsBytes)
-	json.Unmarshal(berthAsBytes, &berthIndex)								//un stringify it aka JSON.parse()
-	//fmt.Print("poIndex : ")
-	//fmt.Println(poIndex)
-	//fmt.Println("len(poIndex) : ")
-	//fmt.Println(len(poIndex))
-	count := 0
-	jsonResp = "{"
-	for i,val := range berthIndex{
-		fmt.Println(strconv.Itoa(i) + " - looking at " + val + " for getBerth_byTO")
-		valueAsBytes, err := stub.GetState(val)
-		if err != nil {
-			errResp = "{\"Error\":\"Failed to get state for " + val + "\"}"
-			return nil, errors.New(errResp)
-		}
-		//fmt.Print("valueAsBytes : ")
-		//fmt.Println(valueAsBytes)
-		json.Unmarshal(valueAsBytes, &valIndex)
-		//fmt.Print("valIndex: ")
-		//fmt.Print(valIndex)
-		if valIndex.TOID == toID{
-			if count > 0 {
-				jsonResp = jsonResp + ","
-			}
-			fmt.Println("TO found")
-			jsonResp = jsonResp + "\""+ val + "\":" + string(valueAsBytes[:])
-			//fmt.Println("jsonResp inside if")
-			//fmt.Println(jsonResp)
-			count++
-		}
-		
-	}
-	jsonResp = jsonResp + "}"
-	//fmt.Println("jsonResp : " + jsonResp)
-	//fmt.Print("jsonResp in bytes : ")
-	//fmt.Println([]byte(jsonResp))
+	toID := args[0]
 	fmt.Println("end getBerth_byTO")
-	return []byte(jsonResp), nil											//send it onward
+	return findBookingsByField(stub, "toID", toID)
 }
 // ============================================================================================================================
-// getBerth_byID - get Berth details for a specific ID from chaincode state
+// getBerth_byOwner - get all bookings for vessels of an owner
 // ============================================================================================================================
 func (t *ManageBerth) getBerth_byOwner(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var jsonResp, ownerName, errResp string
-	var berthIndex []string
-	var valIndex Berth
 	fmt.Println("start getBerth_byOwner")
-	var err error
 	if len(args) != 1 {
 		return nil, errors.New("Incorrect number of arguments. Expecting 1 argument")
 	}
-	// set buyer's name
-	ownerName = args[0]
-	//fmt.Println("buyerName" + buyerName)
-	berthAsBytes, err := stub.GetState(BerthIndexStr)
-	if err != nil {
-		return nil, errors.New("Failed to get Berth index string")
-	}
-	//fmt.Print("poAsBytes : ")
-	//fmt.Println(poAsBytes)
-	json.Unmarshal(berthAsBytes, &berthIndex)								//un stringify it aka JSON.parse()
-	//fmt.Print("poIndex : ")
-	//fmt.Println(poIndex)
-	//fmt.Println("len(poIndex) : ")
-	//fmt.Println(len(poIndex))
-	count := 0
-	jsonResp = "{"
-	for i,val := range berthIndex{
-		fmt.Println(strconv.Itoa(i) + " - looking at " + val + " for getBerth_byOwner")
-		valueAsBytes, err := stub.GetState(val)
-		if err != nil {
-			errResp = "{\"Error\":\"Failed to get state for " + val + "\"}"
-			return nil, errors.New(errResp)
-		}
-		//fmt.Print("valueAsBytes : ")
-		//fmt.Println(valueAsBytes)
-		json.Unmarshal(valueAsBytes, &valIndex)
-		//fmt.Print("valIndex: ")
-		//fmt.Print(valIndex)
-		if valIndex.OwnerName == ownerName{
-			if count > 0 {
-				jsonResp = jsonResp + ","
-			}
-			fmt.Println("ownerName found")
-			jsonResp = jsonResp + "\""+ val + "\":" + string(valueAsBytes[:])
-			//fmt.Println("jsonResp inside if")
-			//fmt.Println(jsonResp)
-			count++
-		}
-		
-	}
-	jsonResp = jsonResp + "}"
-	//fmt.Println("jsonResp : " + jsonResp)
-	//fmt.Print("jsonResp in bytes : ")
-	//fmt.Println([]byte(jsonResp))
+	ownerName := args[0]
 	fmt.Println("end getBerth_byOwner")
-	return []byte(jsonResp), nil											//send it onward	
+	return findBookingsByField(stub, "ownerName", ownerName)
 }
 // ============================================================================================================================
-// getBerth_byID - get Berth details for a specific ID from chaincode state
+// getBerth_bySA - get all bookings made by a shipping agent
 // ============================================================================================================================
 func (t *ManageBerth) getBerth_bySA(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var jsonResp, agentRefNumber, errResp string
-	var berthIndex []string
-	var valIndex Berth
 	fmt.Println("start getBerth_bySA")
-	var err error
 	if len(args) != 1 {
 		return nil, errors.New("Incorrect number of arguments. Expecting 1 argument")
 	}
-	// set buyer's name
-	agentRefNumber = args[0]
-	//fmt.Println("buyerName" + buyerName)
-	berthAsBytes, err := stub.GetState(BerthIndexStr)
-	if err != nil {
-		return nil, errors.New("Failed to get Berth index string")
-	}
-	//fmt.Print("poAsBytes : ")
-	//fmt.Println(poAsBytes)
-	json.Unmarshal(berthAsBytes, &berthIndex)								//un stringify it aka JSON.parse()
-	//fmt.Print("poIndex : ")
-	//fmt.Println(poIndex)
-	//fmt.Println("len(poIndex) : ")
-	//fmt.Println(len(poIndex))
-	count := 0
-	jsonResp = "{"
-	for i,val := range berthIndex{
-		fmt.Println(strconv.Itoa(i) + " - looking at " + val + " for getBerth_bySA")
-		valueAsBytes, err := stub.GetState(val)
-		if err != nil {
-			errResp = "{\"Error\":\"Failed to get state for " + val + "\"}"
-			return nil, errors.New(errResp)
-		}
-		//fmt.Print("valueAsBytes : ")
-		//fmt.Println(valueAsBytes)
-		json.Unmarshal(valueAsBytes, &valIndex)
-		//fmt.Print("valIndex: ")
-		//fmt.Print(valIndex)
-		if valIndex.AgentRefNumber == agentRefNumber{
-			if count > 0 {
-				jsonResp = jsonResp + ","
-			}
-			fmt.Println("agentRefNumber found")
-			jsonResp = jsonResp + "\""+ val + "\":" + string(valueAsBytes[:])
-			//fmt.Println("jsonResp inside if")
-			//fmt.Println(jsonResp)
-			count++
-		}
-		
-	}
-	jsonResp = jsonResp + "}"
-	//fmt.Println("jsonResp : " + jsonResp)
-	//fmt.Print("jsonResp in bytes : ")
-	//fmt.Println([]byte(jsonResp))
+	agentRefNumber := args[0]
 	fmt.Println("end getBerth_bySA")
-	return []byte(jsonResp), nil
+	return findBookingsByField(stub, "agentRefNumber", agentRefNumber)
 }
 // ============================================================================================================================
-// getBerth_byID - get Berth details for a specific ID from chaincode state
+// getBerth_byPA - get all bookings of a port authority approver
 // ============================================================================================================================
 func (t *ManageBerth) getBerth_byPA(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var jsonResp, approverID, errResp string
-	var berthIndex []string
-	var valIndex Berth
 	fmt.Println("start getBerth_byPA")
-	var err error
 	if len(args) != 1 {
 		return nil, errors.New("Incorrect number of arguments. Expecting 1 argument")
 	}
-	// set buyer's name
-	approverID = args[0]
-	//fmt.Println("buyerName" + buyerName)
-	berthAsBytes, err := stub.GetState(BerthIndexStr)
-	if err != nil {
-		return nil, errors.New("Failed to get Berth index string")
-	}
-	//fmt.Print("poAsBytes : ")
-	//fmt.Println(poAsBytes)
-	json.Unmarshal(berthAsBytes, &berthIndex)								//un stringify it aka JSON.parse()
-	//fmt.Print("poIndex : ")
-	//fmt.Println(poIndex)
-	//fmt.Println("len(poIndex) : ")
-	//fmt.Println(len(poIndex))
-	count := 0
-	jsonResp = "{"
-	for i,val := range berthIndex{
-		fmt.Println(strconv.Itoa(i) + " - looking at " + val + " for getBerth_byPA")
-		valueAsBytes, err := stub.GetState(val)
-		if err != nil {
-			errResp = "{\"Error\":\"Failed to get state for " + val + "\"}"
-			return nil, errors.New(errResp)
-		}
-		//fmt.Print("valueAsBytes : ")
-		//fmt.Println(valueAsBytes)
-		json.Unmarshal(valueAsBytes, &valIndex)
-		//fmt.Print("valIndex: ")
-		//fmt.Print(valIndex)
-		if valIndex.ApproverID == approverID{
-			if count > 0 {
-				jsonResp = jsonResp + ","
-			}
-			fmt.Println("approverID found")
-			jsonResp = jsonResp + "\""+ val + "\":" + string(valueAsBytes[:])
-			//fmt.Println("jsonResp inside if")
-			//fmt.Println(jsonResp)
-			count++
-		} 
-		
-	}
-	jsonResp = jsonResp + "}"
-	//fmt.Println("jsonResp : " + jsonResp)
-	//fmt.Print("jsonResp in bytes : ")
-	//fmt.Println([]byte(jsonResp))
+	approverID := args[0]
 	fmt.Println("end getBerth_byPA")
-	return []byte(jsonResp), nil
+	return findBookingsByField(stub, "approverID", approverID)
 }
 // ============================================================================================================================
-//  get_AllBerth- get details of all Berth from chaincode state
+// getBerth_byAllocatedBerth - get all bookings allocated to a specific berth code
+// ============================================================================================================================
+func (t *ManageBerth) getBerth_byAllocatedBerth(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("start getBerth_byAllocatedBerth")
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting berth code")
+	}
+	berthCode := args[0]
+	fmt.Println("end getBerth_byAllocatedBerth")
+	return findBookingsByField(stub, "allocatedBerth", berthCode)
+}
+// ============================================================================================================================
+//  get_AllBerth- get one page of all Berth from chaincode state, in booking ID order
 // ============================================================================================================================
 func (t *ManageBerth) get_AllBerth(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var jsonResp, errResp string
-	var berthIndex []string
 	fmt.Println("start get_AllBerth")
-	var err error
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1 argument")
+	pageSize, bookmark, err := parsePageArgs(args)
+	if err != nil {
+		return nil, err
 	}
-	berthAsBytes, err := stub.GetState(BerthIndexStr)
+	caller, err := getCaller(stub)
 	if err != nil {
-		return nil, errors.New("Failed to get Berth index")
+		return nil, err
 	}
-	//fmt.Print("berthAsBytes : ")
-	//fmt.Println(berthAsBytes)
-	json.Unmarshal(berthAsBytes, &berthIndex)								//un stringify it aka JSON.parse()
-	//fmt.Print("poIndex : ")
-	//fmt.Println(poIndex)
-	jsonResp = "{"
-	for i,val := range berthIndex{
-		fmt.Println(strconv.Itoa(i) + " - looking at " + val + " for all Berth")
-		valueAsBytes, err := stub.GetState(val)
+	var berthIndex []string
+	if scope := caller.bookingScope(); scope != nil {
+		records, err := findBookings(stub, scope, nil)						//only the bookings the caller may see
 		if err != nil {
-			errResp = "{\"Error\":\"Failed to get state for " + val + "\"}"
-			return nil, errors.New(errResp)
-		}
-		//fmt.Print("valueAsBytes : ")
-		//fmt.Println(valueAsBytes)
-		jsonResp = jsonResp + "\""+ val + "\":" + string(valueAsBytes[:])
-		if i < len(berthIndex)-1 {
-			jsonResp = jsonResp + ","
-		}
-	}
-	//fmt.Println("len(poIndex) : ")
-	//fmt.Println(len(poIndex))
-	jsonResp = jsonResp + "}"
-	//fmt.Println("jsonResp : " + jsonResp)
-	//fmt.Print("jsonResp in bytes : ")
-	//fmt.Println([]byte(jsonResp))
+			return nil, err
+		}
+		for _, res := range records {
+			berthIndex = append(berthIndex, res.BookingID)
+		}
+	} else {
+		berthIndex, err = getBerthIndex(stub)
+		if err != nil {
+			return nil, err
+		}
+	}
 	fmt.Println("end get_AllBerth")
-	return []byte(jsonResp), nil
-											//send it onward
+	return readBerthPage(stub, berthIndex, pageSize, bookmark)
 }
 // ============================================================================================================================
 // Delete - remove a Berth from chain
@@ -461,63 +387,90 @@ func (t *ManageBerth) delete_berth(stub shim.ChaincodeStubInterface, args []stri
 	if len(args) != 1 {
 		return nil, errors.New("Incorrect number of arguments. Expecting 1") 
 	}
-	// set berthID
-	vesselID := args[0]
-	err := stub.DelState(vesselID)													//remove the Berth from chaincode
+	// set bookingID
+	bookingID := args[0]
+	berthAsBytes, err := stub.GetState(bookingID)
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + bookingID)
+	}
+	if berthAsBytes == nil {
+		return nil, newError(ERR_NOT_FOUND, "Booking " + bookingID + " not found")
+	}
+	res := Berth{}
+	json.Unmarshal(berthAsBytes, &res)
+	actor, err := getActor(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.DelState(bookingID)													//remove the Berth from chaincode
 	if err != nil {
 		return nil, errors.New("Failed to delete state")
 	}
-
-	//get the Berth index
-	berthAsBytes, err := stub.GetState(BerthIndexStr)
+	err = appendStatusHistory(stub, bookingID, res.BerthBookingStatus, HISTORY_DELETED, actor.ID(), "Booking deleted", "")		//the timeline outlives the booking
 	if err != nil {
-		return nil, errors.New("Failed to get Berth index")
+		return nil, err
 	}
-	//fmt.Println("poAsBytes in delete po")
-	//fmt.Println(poAsBytes);
-	var berthIndex []string
-	json.Unmarshal(berthAsBytes, &berthIndex)								//un stringify it aka JSON.parse()
-	//fmt.Println("poIndex in delete po")
-	//fmt.Println(poIndex);
-	//remove marble from index
-	for i,val := range berthIndex{
-		fmt.Println(strconv.Itoa(i) + " - looking at " + val + " for " + vesselID)
-		if val == vesselID{															//find the correct Berth
-			fmt.Println("found Berth with matching berthID")
-			berthIndex = append(berthIndex[:i], berthIndex[i+1:]...)			//remove it
-			for x:= range berthIndex{											//debug prints...
-				fmt.Println(string(x) + " - " + berthIndex[x])
-			}
-			break
+	if res.BookingID == bookingID {
+		err = updateBookingIndexes(stub, &res, nil)
+		if err != nil {
+			return nil, err
 		}
 	}
-	jsonAsBytes, _ := json.Marshal(berthIndex)									//save new index
-	err = stub.PutState(BerthIndexStr, jsonAsBytes)
+	err = removeLegacyBookingKeys(stub, res.VesselID, bookingID)		//only touches data not yet migrated by migrate_berth_index
+	if err != nil {
+		return nil, err
+	}
 	return nil, nil
 }
 // ============================================================================================================================
 // Write - update Berth into chaincode state
 // ============================================================================================================================
 func (t *ManageBerth) update_berth(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var jsonResp string
 	var err error
 	fmt.Println("start update_berth")
-	if len(args) != 20 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 15.")
+	if len(args) == 1 {
+		args, err = payloadToArgs(args[0], updateBookingOrder, bookingSchema)
+		if err != nil {
+			return nil, err
+		}
+	} else if len(args) == 24 {
+		fmt.Println("update_berth: positional arguments are deprecated, pass a single JSON document instead")
+	} else {
+		return nil, errors.New("Incorrect number of arguments. Expecting a single JSON document (or 24 positional arguments, deprecated).")
 	}
-	// set vesselID
-	vesselID := args[0]
-	berthAsBytes, err := stub.GetState(vesselID)									//get the Berth for the specified vesselID from chaincode state
+	err = sanitizeArgs(args)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + vesselID + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, err
+	}
+	// set bookingID
+	bookingID := args[0]
+	berthAsBytes, err := stub.GetState(bookingID)									//get the Berth for the specified bookingID from chaincode state
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + bookingID)
 	}
 	//fmt.Print("berthAsBytes in update berth")
 	//fmt.Println(berthAsBytes);
 	res := Berth{}
-	json.Unmarshal(berthAsBytes, &res)
-	if res.VesselID == vesselID{
-		fmt.Println("Berth found with vesselID : " + vesselID)
+	err = json.Unmarshal(berthAsBytes, &res)
+	if berthAsBytes != nil && err != nil {
+		return nil, errors.New("Booking " + bookingID + " is malformed, run repair_berth_records")
+	}
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	if res.BookingID == bookingID{
+		fmt.Println("Berth found with bookingID : " + bookingID)
+		err = checkBookingAccess(caller, res)
+		if err != nil {
+			return nil, err
+		}
+		if args[11] != res.RotationNumber{
+			return nil, newError(ERR_CONFLICT, "Rotation number is part of booking ID " + bookingID + " and cannot be changed")
+		}
+		if res.BerthBookingStatus != STATUS_NEW && res.BerthBookingStatus != STATUS_IN_PROGRESS && res.BerthBookingStatus != STATUS_DECLINED{
+			return nil, newError(ERR_CONFLICT, "Booking " + bookingID + " is '" + res.BerthBookingStatus + "' and can no longer be updated")
+		}
 		//fmt.Println(res);
 		res.VesselName = args[1]
 		res.VesselType = args[2]
@@ -529,43 +482,46 @@ func (t *ManageBerth) update_berth(stub shim.ChaincodeStubInterface, args []stri
 		res.ArriveFrom = args[8]
 		res.Terminal = args[9]
 		res.Remarks = args[10]
-		res.BerthBookingStatus = "New"
 		res.RotationNumber = args[11]
-		res.TOID = args[12]
-		res.ApproverID = args[13]
+		if strings.TrimSpace(args[13]) != "" && args[13] != res.ApproverID {
+			return nil, errApproverNotEditable()
+		}
+		allocation := []struct {
+			field string
+			value string
+			stored string
+		}{{"toID", args[12], res.TOID}, {"allocatedBerth", args[19], res.AllocatedBerth}, {"allocatedETB", args[22], res.AllocatedETB}, {"allocatedETD", args[23], res.AllocatedETD}}
+		for _, f := range allocation {
+			if strings.TrimSpace(f.value) != "" && f.value != f.stored {		//only update_berth_allocation and the terminal confirmation set these
+				return nil, errAllocationNotEditable(f.field)
+			}
+		}
 		res.MMSInumber = args[14]
 		res.PortOfRegisteration = args[15]
 		res.OwnerName = args[16]
 		res.OwnerPhoneNumber = args[17]
+		if args[18] != res.PreferredBerth {										//a berth retired since it was asked for stays on the booking
+			err = checkBerthMaster(stub, "Preferred berth", args[18])
+			if err != nil {
+				return nil, err
+			}
+		}
 		res.PreferredBerth = args[18]
-		res.AllocatedBerth = args[19]
+		res.RequestedETB = args[20]
+		res.RequestedETD = args[21]
+	} else {
+		return nil, newError(ERR_NOT_FOUND, "Booking " + bookingID + " not found")
 	}
-	
-	//build the Berth json string manually
-	berthDetails := 	`{`+
-		`"vesselID": "` + res.VesselID + `" , `+
-		`"vesselName": "` + res.VesselName + `" , `+
-		`"vesselType": "` + res.VesselType + `" , `+
-		`"vesselClass": "` + res.VesselClass + `" , `+
-		`"agentRefNumber": "` + res.AgentRefNumber + `" , `+ 
-		`"arrivalPort": "` + res.ArrivalPort + `" , `+ 
-		`"inboundVoyageNo": "` + res.InboundVoyageNo + `" , `+ 
-		`"outboundVoyageNo": "` + res.OutboundVoyageNo + `" , `+ 
-		`"arriveFrom": "` + res.ArriveFrom + `" , `+ 
-		`"terminal": "` + res.Terminal + `" , `+ 
-		`"remarks": "` +  res.Remarks + `" , `+ 
-		`"berthBookingStatus": "` + res.BerthBookingStatus + `" , `+ 
-		`"rotationNumber": "` + res.RotationNumber + `" , `+ 
-		`"toID": "` +  res.TOID + `" , `+ 
-		`"approverID": "` + res.ApproverID + `" , `+ 
-		`"mmsiNumber": "` + res.MMSInumber + `" , `+ 
-		`"portOfRegisteration": "` + res.PortOfRegisteration + `" , `+ 
-		`"ownerName": "` + res.OwnerName + `" , `+ 
-		`"ownerPhoneNumber": "` + res.OwnerPhoneNumber + `" , `+  
-		`"preferredBerth": "` + res.PreferredBerth + `" ,`+ 
-		`"allocatedBerth": "` + res.AllocatedBerth + `" `+
-		`}`
-	err = stub.PutState(vesselID, []byte(berthDetails))									//store Berth with id as key
+	err = checkBookingAccess(caller, res)										//an agent cannot hand a booking to another agent
+	if err != nil {
+		return nil, err
+	}
+	err = checkBerthingWindow("Requested", res.RequestedETB, res.RequestedETD, true)
+	if err != nil {
+		return nil, err
+	}
+
+	err = saveBerth(stub, res)												//store Berth with bookingID as key
 	if err != nil {
 		return nil, err
 	}
@@ -576,8 +532,19 @@ func (t *ManageBerth) update_berth(stub shim.ChaincodeStubInterface, args []stri
 // ============================================================================================================================
 func (t *ManageBerth) create_berth(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var err error
-	if len(args) != 19 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 15")
+	if len(args) == 1 {
+		args, err = payloadToArgs(args[0], createBookingOrder, bookingSchema)
+		if err != nil {
+			return nil, err
+		}
+	} else if len(args) == 21 {
+		fmt.Println("create_berth: positional arguments are deprecated, pass a single JSON document instead")
+	} else {
+		return nil, errors.New("Incorrect number of arguments. Expecting a single JSON document (or 21 positional arguments, deprecated)")
+	}
+	err = sanitizeArgs(args)
+	if err != nil {
+		return nil, err
 	}
 	fmt.Println("start create_berth")
 
@@ -592,19 +559,27 @@ func (t *ManageBerth) create_berth(stub shim.ChaincodeStubInterface, args []stri
 	ArriveFrom := args[8]
 	Terminal := args[9]
 	Remarks := args[10]
-	BerthBookingStatus := "New"
+	BerthBookingStatus := STATUS_NEW
 	RotationNumber := args[11]
 	TOID := args[12]
-	ApproverID := args[13]
+	if strings.TrimSpace(args[13]) != "" {
+		return nil, errApproverNotEditable()
+	}
 	MMSInumber := args[14]
 	PortOfRegisteration := args[15]
 	OwnerName := args[16]
 	OwnerPhoneNumber := args[17]
 	PreferredBerth := args[18]
+	RequestedETB := args[19]
+	RequestedETD := args[20]
+	if strings.TrimSpace(VesselID) == "" || strings.TrimSpace(RotationNumber) == "" {
+		return nil, newError(ERR_INVALID_ARGUMENT, "VesselID and RotationNumber are required to build the booking ID")
+	}
+	BookingID := makeBookingID(VesselID, RotationNumber)
 	
-	berthAsBytes, err := stub.GetState(VesselID)
+	berthAsBytes, err := stub.GetState(BookingID)
 	if err != nil {
-		return nil, errors.New("Failed to get Berth VesselID")
+		return nil, errors.New("Failed to get Berth BookingID")
 	}
 	//fmt.Print("berthAsBytes: ")
 	//fmt.Println(berthAsBytes)
@@ -612,126 +587,421 @@ func (t *ManageBerth) create_berth(stub shim.ChaincodeStubInterface, args []stri
 	json.Unmarshal(berthAsBytes, &res)
 	//fmt.Print("res: ")
 	//fmt.Println(res)
-	if res.VesselID == VesselID{
+	if berthAsBytes != nil {
 		//fmt.Println("This Berth arleady exists: " + BerthID)
 		//fmt.Println(res);
-		return nil, errors.New("This Berth arleady exists")				//all stop a Berth by this name exists
+		return nil, newError(ERR_ALREADY_EXISTS, "This Berth arleady exists")				//all stop a Berth by this name exists
+	}
+	historyAsBytes, err := stub.GetState(BerthHistoryPrefix + BookingID)
+	if err != nil {
+		return nil, errors.New("Failed to get status history for " + BookingID)
+	}
+	if historyAsBytes != nil {												//deleted bookings keep their timeline, their ID is not given out again
+		return nil, &ChaincodeError{ResponseError{Code: ERR_ALREADY_EXISTS, Message: "Booking " + BookingID + " was deleted, book the port call under another rotation number", Field: "rotationNumber"}}
+	}
+	err = checkBerthMaster(stub, "Preferred berth", PreferredBerth)
+	if err != nil {
+		return nil, err
+	}
+	err = checkBerthingWindow("Requested", RequestedETB, RequestedETD, true)
+	if err != nil {
+		return nil, err
 	}
-	
-	//build the Berth json string manually
-	berthDetails := 	`{`+
-		`"vesselID": "` + VesselID + `" , `+
-		`"vesselName": "` + VesselName + `" , `+
-		`"vesselType": "` + VesselType + `" , `+
-		`"vesselClass": "` + VesselClass + `" , `+ 
-		`"agentRefNumber": "` + AgentRefNumber + `" , `+ 
-		`"arrivalPort": "` + ArrivalPort + `" , `+ 
-		`"inboundVoyageNo": "` + InboundVoyageNo + `" , `+ 
-		`"outboundVoyageNo": "` + OutboundVoyageNo + `" , `+ 
-		`"arriveFrom": "` + ArriveFrom + `" , `+ 
-		`"terminal": "` + Terminal + `" , `+ 
-		`"remarks": "` +  Remarks + `" , `+ 
-		`"berthBookingStatus": "` + BerthBookingStatus + `" , `+ 
-		`"rotationNumber": "` + RotationNumber + `" , `+ 
-		`"toID": "` +  TOID + `" , `+ 
-		`"approverID": "` + ApproverID + `" , `+ 
-		`"mmsiNumber": "` + MMSInumber + `" , `+ 
-		`"portOfRegisteration": "` + PortOfRegisteration + `" , `+ 
-		`"ownerName": "` + OwnerName + `" , `+ 
-		`"preferredBerth": "` + PreferredBerth + `" , `+
-		`"ownerPhoneNumber": "` + OwnerPhoneNumber + `" , `+ 
-		`"preferredBerth": "` + PreferredBerth + `" `+ 
-		`}`
 
-		//fmt.Println("berthDetails: " + berthDetails)
-		fmt.Print("Berth details in bytes array: ")
-		fmt.Println([]byte(berthDetails))
-	err = stub.PutState(VesselID, []byte(berthDetails))									//store Berth with BerthID as key
+	res = Berth{
+		BookingID: BookingID,
+		VesselID: VesselID,
+		VesselName: VesselName,
+		VesselType: VesselType,
+		VesselClass: VesselClass,
+		AgentRefNumber: AgentRefNumber,
+		ArrivalPort: ArrivalPort,
+		InboundVoyageNo: InboundVoyageNo,
+		OutboundVoyageNo: OutboundVoyageNo,
+		ArriveFrom: ArriveFrom,
+		Terminal: Terminal,
+		Remarks: Remarks,
+		BerthBookingStatus: BerthBookingStatus,
+		RotationNumber: RotationNumber,
+		TOID: TOID,
+		MMSInumber: MMSInumber,
+		PortOfRegisteration: PortOfRegisteration,
+		OwnerName: OwnerName,
+		OwnerPhoneNumber: OwnerPhoneNumber,
+		PreferredBerth: PreferredBerth,
+		RequestedETB: RequestedETB,
+		RequestedETD: RequestedETD,
+	}
+	caller, err := getCaller(stub)
 	if err != nil {
 		return nil, err
 	}
-	//get the Berth index
-	berthIndexAsBytes, err := stub.GetState(BerthIndexStr)
+	err = checkBookingAccess(caller, res)										//agents book under their own reference number
 	if err != nil {
-		return nil, errors.New("Failed to get Berth index")
+		return nil, err
 	}
-	var berthIndex []string
-	//fmt.Print("berthIndexAsBytes: ")
-	//fmt.Println(berthIndexAsBytes)
-	
-	json.Unmarshal(berthIndexAsBytes, &berthIndex)							//un stringify it aka JSON.parse()
-	//fmt.Print("poIndex after unmarshal..before append: ")
-	//fmt.Println(poIndex)
-	//append
-	berthIndex = append(berthIndex, VesselID)									//add Berth transID to index list
-	//fmt.Println("! Berth index after appending transId: ", poIndex)
-	jsonAsBytes, _ := json.Marshal(berthIndex)
-	//fmt.Print("jsonAsBytes: ")
-	//fmt.Println(jsonAsBytes)
-	err = stub.PutState(BerthIndexStr, jsonAsBytes)						//store name of Berth
+	actor, err := getActor(stub)
+	if err != nil {
+		return nil, err
+	}
+	res.CreatedBy = actor.ID()
+	res.CreatedAt = actor.Time
+	err = saveBerth(stub, res)												//store Berth with BookingID as key
+	if err != nil {
+		return nil, err
+	}
+	err = appendStatusHistory(stub, BookingID, "", BerthBookingStatus, actor.ID(), "Booking created", "")
 	if err != nil {
 		return nil, err
 	}
-
 	fmt.Println("end create_berth")
-	return nil, nil
+	return []byte(BookingID), nil
 }
 
 // ============================================================================================================================
-// Write - update Berth into chaincode state
+// Write - update Berth into chaincode state, through the Allocation workflows only (see checkWorkflowCall)
 // ============================================================================================================================
 func (t *ManageBerth) update_berth_allocationStatus(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var jsonResp string
 	var err error
 	fmt.Println("start update_berth_allocationStatus")
-	if len(args) != 3 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 3.")
+	if len(args) < 3 || len(args) > 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3 to 5: bookingID, status, approverID (blank for the signer), remarks and a reason code. Rejected and Cancelled need remarks and a reason code.")
+	}
+	reason := ""
+	if len(args) >= 4 {
+		reason = args[3]
+	}
+	reasonCode := ""
+	if len(args) == 5 {
+		reasonCode = normalizeReasonCode(args[4])
 	}
-	// set vesselID
-	vesselID := args[0]
-	berthAsBytes, err := stub.GetState(vesselID)									//get the Berth for the specified vesselID from chaincode state
+	err = sanitizeArgs(args)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + vesselID + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, err
+	}
+	// set bookingID
+	bookingID := args[0]
+	berthAsBytes, err := stub.GetState(bookingID)									//get the Berth for the specified bookingID from chaincode state
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + bookingID)
 	}
 	//fmt.Print("berthAsBytes in update berth")
 	//fmt.Println(berthAsBytes);
 	res := Berth{}
-	json.Unmarshal(berthAsBytes, &res)
-	if res.VesselID == vesselID{
-		fmt.Println("Berth found with vesselID : " + vesselID)
+	err = json.Unmarshal(berthAsBytes, &res)
+	if berthAsBytes != nil && err != nil {
+		return nil, errors.New("Booking " + bookingID + " is malformed, run repair_berth_records")
+	}
+	if res.BookingID == bookingID{
+		fmt.Println("Berth found with bookingID : " + bookingID)
+		caller, err := getCaller(stub)
+		if err != nil {
+			return nil, err
+		}
+		err = checkWorkflowCall(stub, caller)
+		if err != nil {
+			return nil, err
+		}
+		err = checkStatusPermission(caller, res, args[1])
+		if err != nil {
+			return nil, err
+		}
+		err = checkStatusTransition(res.BerthBookingStatus, args[1])
+		if err != nil {
+			return nil, err
+		}
+		err = checkReason(stub, args[1], reasonCode, reason)
+		if err != nil {
+			return nil, err
+		}
+		if args[1] == STATUS_CONFIRMED || args[1] == STATUS_APPROVED {
+			err = checkBerthFree(stub, res)
+			if err != nil {
+				return nil, err
+			}
+		}
+		actor, err := checkApprover(stub, args[2])
+		if err != nil {
+			return nil, err
+		}
+		if (args[1] == STATUS_CONFIRMED || args[1] == STATUS_DECLINED) && res.TOID != "" && !actor.matches(res.TOID) {
+			return nil, &ChaincodeError{ResponseError{Code: ERR_FORBIDDEN, Message: "Booking " + bookingID + " is addressed to terminal operator " + res.TOID, Field: "toID"}}
+		}
+		err = appendStatusHistory(stub, bookingID, res.BerthBookingStatus, args[1], actor.ID(), reason, reasonCode)
+		if err != nil {
+			return nil, err
+		}
 		res.BerthBookingStatus = args[1]
-		res.ApproverID = args[2]
+		if args[1] == STATUS_CONFIRMED || args[1] == STATUS_DECLINED {			//terminal operator stage
+			res.TOID = actor.ID()
+			res.TODecision = args[1]
+			res.TODecisionAt = actor.Time
+			res.TORemarks = reason
+		}
+		if args[1] == STATUS_APPROVED || args[1] == STATUS_REJECTED {				//port authority stage
+			res.ApproverID = actor.ID()										//the approver is whoever signed the decision
+			res.PADecision = args[1]
+			res.PADecisionAt = actor.Time
+			res.PARemarks = reason
+		}
+		if reasonCode != "" {
+			res.ReasonCode = reasonCode
+			res.ReasonRemarks = reason
+		}
+	} else {
+		return nil, newError(ERR_NOT_FOUND, "Booking " + bookingID + " not found")
 	}
-	
-	//build the Berth json string manually
-	berthDetails := 	`{`+
-		`"vesselID": "` + res.VesselID + `" , `+
-		`"vesselName": "` + res.VesselName + `" , `+
-		`"vesselType": "` + res.VesselType + `" , `+
-		`"vesselClass": "` + res.VesselClass + `" , `+ 
-		`"agentRefNumber": "` + res.AgentRefNumber + `" , `+ 
-		`"arrivalPort": "` + res.ArrivalPort + `" , `+ 
-		`"inboundVoyageNo": "` + res.InboundVoyageNo + `" , `+ 
-		`"outboundVoyageNo": "` + res.OutboundVoyageNo + `" , `+ 
-		`"arriveFrom": "` + res.ArriveFrom + `" , `+ 
-		`"terminal": "` + res.Terminal + `" , `+ 
-		`"remarks": "` +  res.Remarks + `" , `+ 
-		`"berthBookingStatus": "` + res.BerthBookingStatus + `" , `+ 
-		`"rotationNumber": "` + res.RotationNumber + `" , `+ 
-		`"toID": "` +  res.TOID + `" , `+ 
-		`"approverID": "` + res.ApproverID + `" , `+ 
-		`"mmsiNumber": "` + res.MMSInumber + `" , `+ 
-		`"portOfRegisteration": "` + res.PortOfRegisteration + `" , `+ 
-		`"ownerName": "` + res.OwnerName + `" , `+ 
-		`"ownerPhoneNumber": "` + res.OwnerPhoneNumber + `" , `+ 
-		`"preferredBerth": "` + res.PreferredBerth + `" , `+ 
-		`"allocatedBerth": "` + res.AllocatedBerth + `" `+
-		
-		`}`
-	err = stub.PutState(vesselID, []byte(berthDetails))									//store Berth with id as key
+
+	err = saveBerth(stub, res)												//store Berth with bookingID as key
 	if err != nil {
 		return nil, err
 	}
 	return nil, nil
 }
+
+// ============================================================================================================================
+// update_berth_allocation - write the allocated berth and window onto a booking that is not yet approved
+// ============================================================================================================================
+func (t *ManageBerth) update_berth_allocation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+	fmt.Println("start update_berth_allocation")
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4: bookingID, allocatedBerth, allocatedETB, allocatedETD.")
+	}
+	err = sanitizeArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	// set bookingID
+	bookingID := args[0]
+	berthAsBytes, err := stub.GetState(bookingID)									//get the Berth for the specified bookingID from chaincode state
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + bookingID)
+	}
+	res := Berth{}
+	err = json.Unmarshal(berthAsBytes, &res)
+	if berthAsBytes != nil && err != nil {
+		return nil, errors.New("Booking " + bookingID + " is malformed, run repair_berth_records")
+	}
+	if res.BookingID == bookingID{
+		fmt.Println("Berth found with bookingID : " + bookingID)
+		caller, err := getCaller(stub)
+		if err != nil {
+			return nil, err
+		}
+		err = checkBookingAccess(caller, res)
+		if err != nil {
+			return nil, err
+		}
+		if res.BerthBookingStatus != STATUS_NEW && res.BerthBookingStatus != STATUS_IN_PROGRESS && res.BerthBookingStatus != STATUS_DECLINED{
+			return nil, newError(ERR_CONFLICT, "Booking " + bookingID + " is '" + res.BerthBookingStatus + "' and can no longer be allocated")
+		}
+		err = checkBerthMaster(stub, "Allocated berth", args[1])
+		if err != nil {
+			return nil, err
+		}
+		err = checkBerthTerminal(stub, args[1], res)
+		if err != nil {
+			return nil, err
+		}
+		err = checkBerthingWindow("Allocated", args[2], args[3], true)
+		if err != nil {
+			return nil, err
+		}
+		res.AllocatedBerth = args[1]
+		res.AllocatedETB = args[2]
+		res.AllocatedETD = args[3]
+	} else {
+		return nil, newError(ERR_NOT_FOUND, "Booking " + bookingID + " not found")
+	}
+
+	err = saveBerth(stub, res)												//store Berth with bookingID as key
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ============================================================================================================================
+// checkBerthingWindow - validate an ETB/ETD pair, both must be RFC3339 and the berthing must end after it starts
+// ============================================================================================================================
+func checkBerthingWindow(label string, etb string, etd string, required bool) error {
+	if strings.TrimSpace(etb) == "" && strings.TrimSpace(etd) == "" && !required {
+		return nil
+	}
+	start, err := time.Parse(time.RFC3339, etb)
+	if err != nil {
+		return newError(ERR_INVALID_ARGUMENT, label + " ETB must be an RFC3339 timestamp, got '" + etb + "'")
+	}
+	end, err := time.Parse(time.RFC3339, etd)
+	if err != nil {
+		return newError(ERR_INVALID_ARGUMENT, label + " ETD must be an RFC3339 timestamp, got '" + etd + "'")
+	}
+	if !end.After(start) {
+		return newError(ERR_INVALID_ARGUMENT, label + " ETD must be after ETB")
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// checkBerthFree - fail if a booking has no allocated berth, or if its window overlaps an approved or berthed booking on
+// the same berth. The Allocation chaincode checks the same before confirming or approving, this keeps a direct call
+// of update_berth_allocationStatus from skipping it.
+// ============================================================================================================================
+func checkBerthFree(stub shim.ChaincodeStubInterface, res Berth) error {
+	if res.AllocatedBerth == "" {
+		return newError(ERR_CONFLICT, "No berth has been allocated to booking " + res.BookingID)
+	}
+	etb, etd := res.AllocatedETB, res.AllocatedETD
+	if etb == "" && etd == "" {
+		etb, etd = res.RequestedETB, res.RequestedETD
+	}
+	start, startErr := time.Parse(time.RFC3339, etb)
+	end, endErr := time.Parse(time.RFC3339, etd)
+	if startErr != nil || endErr != nil {
+		return newError(ERR_CONFLICT, "Booking " + res.BookingID + " has no valid berthing window")
+	}
+	occupying, err := occupyingBookings(stub, res.AllocatedBerth)
+	if err != nil {
+		return err
+	}
+	conflicts := []string{}
+	for _, other := range occupying {
+		if other.BookingID == res.BookingID {
+			continue
+		}
+		otherStart, startErr := time.Parse(time.RFC3339, other.AllocatedETB)
+		otherEnd, endErr := time.Parse(time.RFC3339, other.AllocatedETD)
+		if startErr != nil || endErr != nil {
+			continue
+		}
+		if start.Before(otherEnd) && otherStart.Before(end) {
+			conflicts = append(conflicts, other.RotationNumber)
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return newError(ERR_CONFLICT, "Berth " + res.AllocatedBerth + " is already approved for an overlapping window to rotation number(s): " + strings.Join(conflicts, ", "))
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// occupyingBookings - the approved or berthed bookings allocated to a berth in booking ID order, whoever the caller is
+// ============================================================================================================================
+func occupyingBookings(stub shim.ChaincodeStubInterface, berthCode string) ([]Berth, error) {
+	bookingIDs, err := lookupBookingIndex(stub, "allocatedBerth", berthCode)
+	if err != nil {
+		return nil, err
+	}
+	legacyIDs, err := getLegacyKeys(stub, BerthIndexStr)						//bookings not yet moved by migrate_berth_index
+	if err != nil {
+		return nil, err
+	}
+	occupying := []Berth{}
+	for _, key := range mergeKeys(bookingIDs, legacyIDs) {
+		other, err := getBerth(stub, key)
+		if err != nil || other == nil || other.AllocatedBerth != berthCode {
+			continue
+		}
+		if other.BerthBookingStatus == STATUS_APPROVED || other.BerthBookingStatus == STATUS_BERTHED {
+			occupying = append(occupying, *other)
+		}
+	}
+	return occupying, nil
+}
+
+// ============================================================================================================================
+// getBerth_occupancy - get the windows a berth is taken for, across every terminal and agent so conflicts are never
+// hidden by the caller's scope. Only the fields needed to plan around a booking are returned.
+// ============================================================================================================================
+func (t *ManageBerth) getBerth_occupancy(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("start getBerth_occupancy")
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting berth code")
+	}
+	occupying, err := occupyingBookings(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	windows := []BerthOccupancy{}
+	for _, res := range occupying {
+		windows = append(windows, BerthOccupancy{
+			BookingID:          res.BookingID,
+			RotationNumber:     res.RotationNumber,
+			AllocatedBerth:     res.AllocatedBerth,
+			AllocatedETB:       res.AllocatedETB,
+			AllocatedETD:       res.AllocatedETD,
+			RequestedETB:       res.RequestedETB,
+			RequestedETD:       res.RequestedETD,
+			BerthBookingStatus: res.BerthBookingStatus,
+		})
+	}
+	fmt.Println("end getBerth_occupancy")
+	return json.Marshal(windows)
+}
+
+// ============================================================================================================================
+// makeBookingID - a port call is identified by the vessel and its rotation number
+// ============================================================================================================================
+func makeBookingID(vesselID string, rotationNumber string) string {
+	return vesselID + "-" + rotationNumber
+}
+
+// ============================================================================================================================
+// migrate_berth_bookingIDs - one-off re-key of bookings that were stored under their bare vesselID
+// ============================================================================================================================
+func (t *ManageBerth) migrate_berth_bookingIDs(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var newIndex, migrated, skipped []string
+	fmt.Println("start migrate_berth_bookingIDs")
+	berthIndex, err := getLegacyKeys(stub, BerthIndexStr)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range berthIndex {
+		valueAsBytes, err := stub.GetState(key)
+		if err != nil {
+			return nil, errors.New("Failed to get state for " + key)
+		}
+		if valueAsBytes == nil {										//deleted long ago, drop it from the index
+			continue
+		}
+		res := Berth{}
+		err = json.Unmarshal(valueAsBytes, &res)
+		if err == nil && res.BookingID != "" {							//already keyed by booking ID
+			newIndex = append(newIndex, key)
+			continue
+		}
+		if err != nil || res.VesselID == "" || res.RotationNumber == "" {		//cannot build a booking ID, leave it for manual repair
+			skipped = append(skipped, key)
+			newIndex = append(newIndex, key)
+			continue
+		}
+		res.BookingID = makeBookingID(res.VesselID, res.RotationNumber)
+		existing, err := stub.GetState(res.BookingID)
+		if err != nil {
+			return nil, errors.New("Failed to get state for " + res.BookingID)
+		}
+		if existing != nil {
+			skipped = append(skipped, key)
+			newIndex = append(newIndex, key)
+			continue
+		}
+		err = saveBerth(stub, res)
+		if err != nil {
+			return nil, err
+		}
+		err = stub.DelState(key)
+		if err != nil {
+			return nil, err
+		}
+		migrated = append(migrated, res.BookingID)							//saveBerth has indexed it under the new key
+	}
+	err = putLegacyKeys(stub, BerthIndexStr, newIndex)
+	if err != nil {
+		return nil, err
+	}
+	report, _ := json.Marshal(map[string][]string{"migrated": migrated, "skipped": skipped})
+	fmt.Println("end migrate_berth_bookingIDs")
+	return report, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var ReasonCodePrefix = "_ReasonCode_" //prefix for reason code keys so they never clash with booking keys
+
+type ReasonCode struct { // One entry of the catalogue of reasons for refusing or cancelling a booking
+	Code           string   `json:"code"`
+	Description    string   `json:"description"`
+	Statuses       []string `json:"statuses"` // booking statuses the code may be given for
+	Active         bool     `json:"active"`
+	LastModifiedBy string   `json:"lastModifiedBy"` // signer of the latest change, empty for the built-in codes
+	LastModifiedAt string   `json:"lastModifiedAt"`
+}
+
+// Statuses that need a reason code and remarks
+var reasonStatuses = []string{STATUS_REJECTED, STATUS_CANCELLED}
+
+// Catalogue used until the port authority changes it, a stored code of the same name replaces the built-in one
+var defaultReasonCodes = []ReasonCode{
+	{Code: "BERTH_UNAVAILABLE", Description: "Berth unavailable", Statuses: []string{STATUS_REJECTED, STATUS_CANCELLED}, Active: true},
+	{Code: "DOCUMENTS_MISSING", Description: "Documents missing", Statuses: []string{STATUS_REJECTED}, Active: true},
+	{Code: "DRAFT_RESTRICTION", Description: "Draft restriction", Statuses: []string{STATUS_REJECTED}, Active: true},
+	{Code: "SANCTIONS_HIT", Description: "Sanctions screening hit", Statuses: []string{STATUS_REJECTED, STATUS_CANCELLED}, Active: true},
+	{Code: "AGENT_REQUEST", Description: "Agent request", Statuses: []string{STATUS_CANCELLED}, Active: true},
+	{Code: "SCHEDULE_CHANGE", Description: "Vessel schedule changed", Statuses: []string{STATUS_CANCELLED}, Active: true},
+	{Code: "OTHER", Description: "Other, see remarks", Statuses: []string{STATUS_REJECTED, STATUS_CANCELLED}, Active: true},
+}
+
+// ============================================================================================================================
+// normalizeReasonCode - reason codes are stored in upper case, every lookup goes through here first
+// ============================================================================================================================
+func normalizeReasonCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// ============================================================================================================================
+// getReasonCode - read a reason code, the stored entry first and the built-in one after, nil when the code is unknown
+// ============================================================================================================================
+func getReasonCode(stub shim.ChaincodeStubInterface, code string) (*ReasonCode, error) {
+	code = normalizeReasonCode(code)
+	codeAsBytes, err := stub.GetState(ReasonCodePrefix + code)
+	if err != nil {
+		return nil, errors.New("Failed to get state for reason code " + code)
+	}
+	if codeAsBytes != nil {
+		res := ReasonCode{}
+		err = json.Unmarshal(codeAsBytes, &res)
+		if err != nil {
+			return nil, errors.New("Corrupt reason code record for " + code)
+		}
+		return &res, nil
+	}
+	for _, res := range defaultReasonCodes {
+		if res.Code == code {
+			return &res, nil
+		}
+	}
+	return nil, nil
+}
+
+// ============================================================================================================================
+// needsReason - does moving a booking to a status need a reason code and remarks
+// ============================================================================================================================
+func needsReason(status string) bool {
+	for _, s := range reasonStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================================================================================
+// checkReason - make sure a status change that needs a reason carries an active reason code for that status and remarks
+// ============================================================================================================================
+func checkReason(stub shim.ChaincodeStubInterface, status string, code string, remarks string) error {
+	code = normalizeReasonCode(code)
+	if !needsReason(status) {
+		if code != "" {
+			return fieldError("reasonCode", "A reason code is only given for "+strings.Join(reasonStatuses, " or "))
+		}
+		return nil
+	}
+	if code == "" {
+		return fieldError("reasonCode", "A reason code is required to move a booking to '"+status+"'")
+	}
+	if strings.TrimSpace(remarks) == "" {
+		return fieldError("remarks", "Remarks are required to move a booking to '"+status+"'")
+	}
+	res, err := getReasonCode(stub, code)
+	if err != nil {
+		return err
+	}
+	if res == nil || !res.Active {
+		return fieldError("reasonCode", "Unknown or retired reason code '"+code+"'")
+	}
+	for _, s := range res.Statuses {
+		if s == status {
+			return nil
+		}
+	}
+	return fieldError("reasonCode", "Reason code '"+code+"' may not be given for '"+status+"'")
+}
+
+// ============================================================================================================================
+// saveReasonCode - stamp a reason code with the signer and time of the change and store it
+// ============================================================================================================================
+func saveReasonCode(stub shim.ChaincodeStubInterface, res ReasonCode) error {
+	actor, err := getActor(stub)
+	if err != nil {
+		return err
+	}
+	res.LastModifiedBy = actor.ID()
+	res.LastModifiedAt = actor.Time
+	codeAsBytes, _ := json.Marshal(res)
+	return stub.PutState(ReasonCodePrefix+res.Code, codeAsBytes)
+}
+
+// ============================================================================================================================
+// set_reason_code - add a reason code to the catalogue or change one, a retired code is brought back into use
+// ============================================================================================================================
+func (t *ManageBerth) set_reason_code(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3: code, description, statuses")
+	}
+	fmt.Println("start set_reason_code")
+	res := ReasonCode{Code: normalizeReasonCode(args[0]), Description: strings.TrimSpace(args[1]), Active: true}
+	if res.Code == "" {
+		return nil, fieldError("code", "Reason code must not be empty")
+	}
+	if res.Description == "" {
+		return nil, fieldError("description", "Description must not be empty")
+	}
+	res.Statuses = []string{}
+	for _, status := range strings.Split(args[2], ",") {
+		status = strings.TrimSpace(status)
+		if status == "" {
+			continue
+		}
+		if !needsReason(status) {
+			return nil, fieldError("statuses", "Reason codes are only given for "+strings.Join(reasonStatuses, " or "))
+		}
+		res.Statuses = append(res.Statuses, status)
+	}
+	if len(res.Statuses) == 0 {
+		return nil, fieldError("statuses", "At least one status is required")
+	}
+	err := saveReasonCode(stub, res)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("end set_reason_code")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// retire_reason_code - stop a reason code from being given, bookings already carrying it keep it
+// ============================================================================================================================
+func (t *ManageBerth) retire_reason_code(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting reason code")
+	}
+	fmt.Println("start retire_reason_code")
+	res, err := getReasonCode(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, newError(ERR_NOT_FOUND, "Reason code "+args[0]+" not found")
+	}
+	res.Active = false
+	err = saveReasonCode(stub, *res)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("end retire_reason_code")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// getReasonCode_byCode - get one entry of the reason code catalogue
+// ============================================================================================================================
+func (t *ManageBerth) getReasonCode_byCode(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting reason code")
+	}
+	res, err := getReasonCode(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, newError(ERR_NOT_FOUND, "Reason code "+args[0]+" not found")
+	}
+	return json.Marshal(res)
+}
+
+// ============================================================================================================================
+// get_AllReasonCodes - get the whole reason code catalogue, retired codes included, ordered by code
+// ============================================================================================================================
+func (t *ManageBerth) get_AllReasonCodes(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("start get_AllReasonCodes")
+	codes := make(map[string]ReasonCode)
+	for _, res := range defaultReasonCodes {
+		codes[res.Code] = res
+	}
+	keysIter, err := stub.RangeQueryState(ReasonCodePrefix, ReasonCodePrefix+string(utf8.MaxRune))
+	if err != nil {
+		return nil, errors.New("Failed to scan reason codes")
+	}
+	defer keysIter.Close()
+	for keysIter.HasNext() {
+		key, codeAsBytes, err := keysIter.Next()
+		if err != nil {
+			return nil, errors.New("Failed to scan reason codes")
+		}
+		res := ReasonCode{}
+		err = json.Unmarshal(codeAsBytes, &res)
+		if err != nil {
+			fmt.Println("skipping malformed reason code " + key)
+			continue
+		}
+		codes[res.Code] = res
+	}
+	var names []string
+	for code := range codes {
+		names = append(names, code)
+	}
+	sort.Strings(names)
+	catalogue := []ReasonCode{}
+	for _, code := range names {
+		catalogue = append(catalogue, codes[code])
+	}
+	jsonAsBytes, _ := json.Marshal(catalogue)
+	fmt.Println("end get_AllReasonCodes")
+	return jsonAsBytes, nil
+}
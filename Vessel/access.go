@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Roles carried in the "role" attribute of the caller's enrollment certificate, shared by the Vessel, Berth and
+// Allocation chaincodes. Keep the three copies of the roles and statusRoles in step. Every certificate also carries
+// an "org" attribute, recorded as the organization of each change the caller signs.
+//
+//	agent              - shipping agent, its "org" attribute is the agent reference number on its bookings
+//	terminal_operator  - its "terminal" attribute names the terminal it runs
+//	port_authority     - approves and rejects allocations
+//	admin              - may do everything, including maintenance functions
+var ROLE_AGENT = "agent"
+var ROLE_TERMINAL_OPERATOR = "terminal_operator"
+var ROLE_PORT_AUTHORITY = "port_authority"
+var ROLE_ADMIN = "admin"
+
+var ANY_ROLE = []string{ROLE_AGENT, ROLE_TERMINAL_OPERATOR, ROLE_PORT_AUTHORITY}
+
+type Caller struct { // Identity of the caller as read from its certificate attributes
+	Role     string `json:"role"`
+	Org      string `json:"org"`
+	UserID   string `json:"userID"`
+	Terminal string `json:"terminal"`
+}
+
+// Roles allowed to call each function, admin may call all of them. Functions missing here are rejected by the
+// dispatch as unknown.
+var functionRoles = map[string][]string{
+	"init":                           {},
+	"create_vessel":                  {ROLE_AGENT},
+	"update_vessel":                  {ROLE_AGENT},
+	"delete_vessel":                  {},
+	"update_vessel_allocationStatus": ANY_ROLE, // see statusRoles, the booking must belong to the caller
+	"set_chaincode_references":       {},
+	"get_chaincode_references":       ANY_ROLE,
+	"repair_vessel_records":          {},
+	"migrate_vessel_index":           {},
+	"getVessel_byID":                 ANY_ROLE,
+	"getVessel_byOwner":              ANY_ROLE,
+	"get_AllVessel":                  ANY_ROLE,
+	"validate_vessel_records":        {},
+}
+
+// Roles allowed to move a booking to each status, admin may make every move
+var statusRoles = map[string][]string{
+	STATUS_IN_PROGRESS: {ROLE_TERMINAL_OPERATOR, ROLE_PORT_AUTHORITY},
+	STATUS_CONFIRMED:   {ROLE_TERMINAL_OPERATOR},
+	STATUS_DECLINED:    {ROLE_TERMINAL_OPERATOR},
+	STATUS_APPROVED:    {ROLE_PORT_AUTHORITY},
+	STATUS_REJECTED:    {ROLE_PORT_AUTHORITY},
+	STATUS_BERTHED:     {ROLE_TERMINAL_OPERATOR},
+	STATUS_DEPARTED:    {ROLE_TERMINAL_OPERATOR},
+	STATUS_CANCELLED:   {ROLE_AGENT},
+}
+
+type Actor struct { // Signed identity behind a state change
+	MSPID   string `json:"mspID"`   // organization of the caller, the "org" attribute of its certificate
+	Subject string `json:"subject"` // subject common name of the caller's certificate
+	Time    string `json:"time"`    // transaction timestamp, RFC3339
+}
+
+// ============================================================================================================================
+// getActor - the identity that signed the transaction and the transaction time, for stamping state changes
+// ============================================================================================================================
+func getActor(stub shim.ChaincodeStubInterface) (Actor, error) {
+	caller, err := getCaller(stub)
+	if err != nil {
+		return Actor{}, err
+	}
+	subject := certificateSubject(stub)
+	if subject == "" {
+		subject = caller.UserID //certificates without a readable subject
+	}
+	if subject == "" {
+		return Actor{}, newError(ERR_FORBIDDEN, "Caller certificate carries neither a subject nor a userID attribute")
+	}
+	timestamp, err := txTimestamp(stub)
+	if err != nil {
+		return Actor{}, err
+	}
+	return Actor{MSPID: caller.Org, Subject: subject, Time: timestamp}, nil
+}
+
+// ============================================================================================================================
+// certificateSubject - common name of the caller's certificate, empty when it cannot be read
+// ============================================================================================================================
+func certificateSubject(stub shim.ChaincodeStubInterface) string {
+	certAsBytes, err := stub.GetCallerCertificate()
+	if err != nil || len(certAsBytes) == 0 {
+		return ""
+	}
+	if block, _ := pem.Decode(certAsBytes); block != nil {
+		certAsBytes = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(certAsBytes)
+	if err != nil {
+		return ""
+	}
+	return cert.Subject.CommonName
+}
+
+// ============================================================================================================================
+// ID - how an actor is written on a record, MSP ID / certificate subject
+// ============================================================================================================================
+func (a Actor) ID() string {
+	return a.MSPID + "/" + a.Subject
+}
+
+// ============================================================================================================================
+// matches - does an approver ID given as an argument name this actor, by its full ID or its certificate subject
+// ============================================================================================================================
+func (a Actor) matches(id string) bool {
+	return id == a.ID() || id == a.Subject
+}
+
+// ============================================================================================================================
+// getCaller - read the caller's role and organization from the transaction certificate
+// ============================================================================================================================
+func getCaller(stub shim.ChaincodeStubInterface) (Caller, error) {
+	caller := Caller{
+		Role:     readAttribute(stub, "role"),
+		Org:      readAttribute(stub, "org"),
+		UserID:   readAttribute(stub, "userID"),
+		Terminal: readAttribute(stub, "terminal"),
+	}
+	if caller.Role != ROLE_ADMIN && !caller.hasRole(ANY_ROLE) {
+		return caller, newError(ERR_FORBIDDEN, "Caller certificate carries no known role attribute")
+	}
+	if caller.Org == "" {
+		return caller, newError(ERR_FORBIDDEN, "Caller certificate carries no org attribute")
+	}
+	if caller.Role == ROLE_TERMINAL_OPERATOR && caller.Terminal == "" {
+		return caller, newError(ERR_FORBIDDEN, "Terminal operator certificate carries no terminal attribute")
+	}
+	return caller, nil
+}
+
+// ============================================================================================================================
+// readAttribute - one attribute of the caller's certificate, empty when it is missing
+// ============================================================================================================================
+func readAttribute(stub shim.ChaincodeStubInterface, name string) string {
+	value, err := stub.ReadCertAttribute(name)
+	if err != nil {
+		return ""
+	}
+	return string(value)
+}
+
+// ============================================================================================================================
+// hasRole - is the caller an admin or one of the given roles
+// ============================================================================================================================
+func (c Caller) hasRole(roles []string) bool {
+	if c.Role == ROLE_ADMIN {
+		return true
+	}
+	for _, role := range roles {
+		if c.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================================================================================
+// authorize - make sure the caller holds a role allowed to call a function
+// ============================================================================================================================
+func authorize(stub shim.ChaincodeStubInterface, function string) error {
+	roles, ok := functionRoles[function]
+	if !ok {
+		return nil
+	}
+	caller, err := getCaller(stub)
+	if err != nil {
+		return err
+	}
+	if !caller.hasRole(roles) {
+		fmt.Println("denied " + function + " to role " + caller.Role)
+		return newError(ERR_FORBIDDEN, "Role '"+caller.Role+"' may not call "+function)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// canSee - may the caller read and act on a booking, the same rule as the Berth chaincode
+// ============================================================================================================================
+func (c Caller) canSee(res Booking) bool {
+	if c.Role == ROLE_AGENT {
+		return res.AgentRefNumber == c.Org
+	}
+	if c.Role == ROLE_TERMINAL_OPERATOR {
+		return res.Terminal == c.Terminal
+	}
+	return true
+}
+
+// ============================================================================================================================
+// checkBookingAccess - make sure the caller may act on a booking
+// ============================================================================================================================
+func checkBookingAccess(caller Caller, res Booking) error {
+	if !caller.canSee(res) {
+		return newError(ERR_FORBIDDEN, "Booking "+res.BookingID+" does not belong to the caller's organization or terminal")
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// checkStatusPermission - make sure the caller may move a vessel's booking to a status
+// ============================================================================================================================
+func checkStatusPermission(caller Caller, res Booking, status string) error {
+	if !caller.hasRole(statusRoles[status]) {
+		return newError(ERR_FORBIDDEN, "Role '"+caller.Role+"' may not move a booking to '"+status+"'")
+	}
+	return checkBookingAccess(caller, res)
+}
+
+// ============================================================================================================================
+// txTimestamp - the transaction timestamp in RFC3339, identical on every peer
+// ============================================================================================================================
+func txTimestamp(stub shim.ChaincodeStubInterface) (string, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return "", errors.New("Failed to get transaction timestamp")
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC().Format(time.RFC3339), nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/util"
+)
+
+var ChaincodeRefsKey = "_ChaincodeRefs" //key of the Berth chaincode the vessel status checks call
+
+type ChaincodeRefs struct { // The chaincode trusted for booking data
+	BerthChaincode string `json:"berthChaincode"`
+	LastModifiedBy string `json:"lastModifiedBy"` // signer of the latest change, empty when set at deployment
+	LastModifiedAt string `json:"lastModifiedAt"`
+}
+
+type Booking struct { // The fields of a Berth booking the vessel status checks need
+	BookingID          string `json:"bookingID"`
+	VesselID           string `json:"vesselID"`
+	AgentRefNumber     string `json:"agentRefNumber"`
+	Terminal           string `json:"terminal"`
+	BerthBookingStatus string `json:"berthBookingStatus"`
+}
+
+// ============================================================================================================================
+// berthChaincode - the Berth chaincode bookings are read from, never taken from the caller
+// ============================================================================================================================
+func berthChaincode(stub shim.ChaincodeStubInterface) (string, error) {
+	refsAsBytes, err := stub.GetState(ChaincodeRefsKey)
+	if err != nil {
+		return "", errors.New("Failed to get the chaincode references")
+	}
+	refs := ChaincodeRefs{}
+	json.Unmarshal(refsAsBytes, &refs)
+	if refs.BerthChaincode == "" {
+		return "", newError(ERR_CONFLICT, "The Berth chaincode is not configured, call init or set_chaincode_references")
+	}
+	return refs.BerthChaincode, nil
+}
+
+// ============================================================================================================================
+// fetchBooking - read a booking from the Berth chaincode as the caller, who must be allowed to see it
+// ============================================================================================================================
+func fetchBooking(stub shim.ChaincodeStubInterface, bookingID string) (Booking, error) {
+	res := Booking{}
+	BerthChainCode, err := berthChaincode(stub)
+	if err != nil {
+		return res, err
+	}
+	f := "getBerth_byBookingID"
+	queryArgs := util.ToChaincodeArgs(f, bookingID)
+	bookingAsBytes, err := unwrapResponse(stub.QueryChaincode(BerthChainCode, queryArgs))
+	if err != nil {
+		errStr := fmt.Sprintf("Failed to query chaincode. Got error: %s", err.Error())
+		fmt.Printf(errStr)
+		return res, remoteError(errStr, err)
+	}
+	json.Unmarshal(bookingAsBytes, &res)
+	if res.BookingID != bookingID {
+		return res, newError(ERR_NOT_FOUND, "Booking "+bookingID+" not found")
+	}
+	return res, nil
+}
+
+// ============================================================================================================================
+// putBerthChaincode - store the Berth chaincode reference, stamped with the signer when there is one
+// ============================================================================================================================
+func putBerthChaincode(stub shim.ChaincodeStubInterface, name string, actor *Actor) error {
+	refs := ChaincodeRefs{BerthChaincode: strings.TrimSpace(name)}
+	if refs.BerthChaincode == "" {
+		return fieldError("berthChaincode", "Berth chaincode must not be empty")
+	}
+	if actor != nil {
+		refs.LastModifiedBy = actor.ID()
+		refs.LastModifiedAt = actor.Time
+	}
+	refsAsBytes, _ := json.Marshal(refs)
+	return stub.PutState(ChaincodeRefsKey, refsAsBytes)
+}
+
+// ============================================================================================================================
+// set_chaincode_references - point the vessel status checks at another Berth chaincode than the one named at deployment
+// ============================================================================================================================
+func (t *ManageVessel) set_chaincode_references(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting BerthChainCode")
+	}
+	fmt.Println("start set_chaincode_references")
+	actor, err := getActor(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = putBerthChaincode(stub, args[0], &actor)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("end set_chaincode_references")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// get_chaincode_references - get the Berth chaincode the vessel status checks call
+// ============================================================================================================================
+func (t *ManageVessel) get_chaincode_references(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	refsAsBytes, err := stub.GetState(ChaincodeRefsKey)
+	if err != nil {
+		return nil, errors.New("Failed to get the chaincode references")
+	}
+	if refsAsBytes == nil {
+		return nil, newError(ERR_NOT_FOUND, "The Berth chaincode is not configured")
+	}
+	return refsAsBytes, nil
+}
@@ -23,6 +23,7 @@ import (
 "errors"
 "fmt"
 "strconv"
+"strings"
 "encoding/json"
 
 "github.com/hyperledger/fabric/core/chaincode/shim"
@@ -34,7 +35,7 @@ var EVENT_COUNTER = "event_counter"
 type ManageVessel struct {
 }
 
-var VesselIndexStr = "_Vesselindex"				//name for the key/value that will store a list of all known Vessel
+var VesselIndexStr = "_Vesselindex"				//legacy list of all known Vessel, replaced by per-vessel index keys
 
 type Vessel struct{							// Attributes of a Vessel 				
 	VesselID string `json:"vesselID"`
@@ -54,6 +55,16 @@ type Vessel struct{							// Attributes of a Vessel
 	OwnerCountry string `json:"ownerCountry"`
 	VesselClass string `json:"vesselClass"`
 	BerthBookingStatus string `json:"berthBookingStatus"`
+	ActiveBookingID string `json:"activeBookingID"`		// booking whose status the vessel carries, empty when none holds it
+	LOA float64 `json:"loa"`						// length overall, metres
+	Beam float64 `json:"beam"`						// metres
+	Draft float64 `json:"draft"`						// maximum draft, metres
+	GT float64 `json:"gt"`							// gross tonnage
+	DWT float64 `json:"dwt"`						// deadweight tonnage
+	CreatedBy string `json:"createdBy"`				// signer of the creating transaction, MSP ID / certificate subject
+	CreatedAt string `json:"createdAt"`				// transaction timestamp, RFC3339
+	LastModifiedBy string `json:"lastModifiedBy"`		// signer of the latest change
+	LastModifiedAt string `json:"lastModifiedAt"`
 }
 // ============================================================================================================================
 // Main - start the chaincode for Vessel management
@@ -65,16 +76,26 @@ func main() {
 	}
 }
 // ============================================================================================================================
-// Init - reset all the things
+// Init - entry point, the answer or failure is wrapped in the response envelope
 // ============================================================================================================================
 func (t *ManageVessel) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	return respond(t.initChaincode(stub, function, args))
+}
+// ============================================================================================================================
+// initChaincode - reset all the things and record the Berth chaincode the vessel status checks call
+// ============================================================================================================================
+func (t *ManageVessel) initChaincode(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	var msg string
 	var err error
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2 args: message, BerthChainCode")
 	}
 	// Initialize the chaincode
 	msg = args[0]
+	err = putBerthChaincode(stub, args[1], nil)
+	if err != nil {
+		return nil, err
+	}
 	fmt.Println("ManageVessel chaincode is deployed successfully.");
 	
 	// Write the state to the ledger
@@ -83,12 +104,6 @@ func (t *ManageVessel) Init(stub shim.ChaincodeStubInterface, function string, a
 		return nil, err
 	}
 	
-	var empty []string
-	jsonAsBytes, _ := json.Marshal(empty)								//marshal an emtpy array of strings to clear the index
-	err = stub.PutState(VesselIndexStr, jsonAsBytes)
-	if err != nil {
-		return nil, err
-	}
 	err = stub.PutState(EVENT_COUNTER, []byte("1"))
 	if err != nil {
 		return nil, err
@@ -103,14 +118,24 @@ func (t *ManageVessel) Init(stub shim.ChaincodeStubInterface, function string, a
 		return t.Invoke(stub, function, args)
 	}
 // ============================================================================================================================
-// Invoke - Our entry point for Invocations
+// Invoke - entry point, the answer or failure is wrapped in the response envelope
+// ============================================================================================================================
+func (t *ManageVessel) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	return respond(t.invokeFunction(stub, function, args))
+}
+// ============================================================================================================================
+// invokeFunction - run an invocation
 // ============================================================================================================================
-	func (t *ManageVessel) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	func (t *ManageVessel) invokeFunction(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 		fmt.Println("invoke is running " + function)
+	err := authorize(stub, function)
+	if err != nil {
+		return nil, err
+	}
 
 	// Handle different functions
 	if function == "init" {													//initialize the chaincode state, used as reset
-		return t.Init(stub, "init", args)
+		return t.initChaincode(stub, "init", args)
 	} else if function == "create_vessel" {											//create a new Vessel
 		return t.create_vessel(stub, args)
 	}else if function == "delete_vessel" {									// delete a Vessel
@@ -119,153 +144,98 @@ func (t *ManageVessel) Init(stub shim.ChaincodeStubInterface, function string, a
 		return t.update_vessel(stub, args)
 	}else if function == "update_vessel_allocationStatus" {									//update a Vessel
 		return t.update_vessel_allocationStatus(stub, args)
+	}else if function == "repair_vessel_records" {									//rewrite stored vessels as well formed JSON
+		return t.repair_vessel_records(stub, args)
+	}else if function == "migrate_vessel_index" {									//move listings off the shared index key
+		return t.migrate_vessel_index(stub, args)
+	}else if function == "set_chaincode_references" {									//point the status checks at another Berth chaincode
+		return t.set_chaincode_references(stub, args)
 	}
 	fmt.Println("invoke did not find func: " + function)					//error
-	return nil, errors.New("Received unknown function invocation")
+	return nil, newError(ERR_INVALID_ARGUMENT, "Received unknown function invocation")
 }
 // ============================================================================================================================
-// Query - Our entry point for Queries
+// Query - entry point, the answer or failure is wrapped in the response envelope
 // ============================================================================================================================
 func (t *ManageVessel) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	return respond(t.queryFunction(stub, function, args))
+}
+// ============================================================================================================================
+// queryFunction - run a query
+// ============================================================================================================================
+func (t *ManageVessel) queryFunction(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	fmt.Println("query is running " + function)
+	err := authorize(stub, function)
+	if err != nil {
+		return nil, err
+	}
 
 	// Handle different functions
 	if function == "getVessel_byID" {													//Read a Vessel by transId
 		return t.getVessel_byID(stub, args)
 	} else if function == "getVessel_byOwner" {													//Read all Vessels
 		return t.getVessel_byOwner(stub, args)
-	} else if function == "get_AllVessel" {													//Read all Vessels
+	} else if function == "get_AllVessel" {													//Read a page of all Vessels
 		return t.get_AllVessel(stub, args)
+	} else if function == "validate_vessel_records" {													//Report malformed stored vessels
+		return t.validate_vessel_records(stub, args)
+	} else if function == "get_chaincode_references" {													//Read the Berth chaincode in use
+		return t.get_chaincode_references(stub, args)
 	}
 	fmt.Println("query did not find func: " + function)						//error
-	return nil, errors.New("Received unknown function query")
+	return nil, newError(ERR_INVALID_ARGUMENT, "Received unknown function query")
 }
 // ============================================================================================================================
 // getVessel_byID - get Vessel details for a specific ID from chaincode state
 // ============================================================================================================================
 func (t *ManageVessel) getVessel_byID(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var vesselID, jsonResp string
-	var err error
 	fmt.Println("start getVessel_byID")
 	if len(args) != 1 {
 		return nil, errors.New("Incorrect number of arguments. Expecting ID of the vessel to query")
 	}
-	// set vesselID
-	vesselID = args[0]
-	valAsbytes, err := stub.GetState(vesselID)									//get the vesselID from chaincode state
+	res, err := getVessel(stub, args[0])									//get the vesselID from chaincode state
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + vesselID + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, err
+	}
+	if res == nil {
+		return nil, newError(ERR_NOT_FOUND, "Vessel " + args[0] + " not found")
 	}
-	//fmt.Print("valAsbytes : ")
-	//fmt.Println(valAsbytes)
 	fmt.Println("end getVessel_byID")
-	return valAsbytes, nil													//send it onward
+	return json.Marshal(res)												//send it onward
 }
 
 // ============================================================================================================================
-// getVessel_byOwner - get Vessel details for a specific ID from chaincode state
+// getVessel_byOwner - get all vessels registered against an owner's phone number
 // ============================================================================================================================
-
 func (t *ManageVessel) getVessel_byOwner(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var jsonResp, ownerPhoneNumber, errResp string
-	var vesselIndex []string
-	var valIndex Vessel
 	fmt.Println("start getVessel_byOwner")
-	var err error
 	if len(args) != 1 {
 		return nil, errors.New("Incorrect number of arguments. Expecting owner name")
 	}
-	// set buyer's name
-	ownerPhoneNumber = args[0]
-	//fmt.Println("buyerName" + buyerName)
-	vesselAsBytes, err := stub.GetState(VesselIndexStr)
+	ownerPhoneNumber := args[0]
+	vesselIDs, err := lookupVesselIndex(stub, "owner", ownerPhoneNumber)
 	if err != nil {
-		return nil, errors.New("Failed to get Vessel index string")
-	}
-	//fmt.Print("poAsBytes : ")
-	//fmt.Println(poAsBytes)
-	json.Unmarshal(vesselAsBytes, &vesselIndex)								//un stringify it aka JSON.parse()
-	//fmt.Print("poIndex : ")
-	//fmt.Println(poIndex)
-	//fmt.Println("len(poIndex) : ")
-	//fmt.Println(len(poIndex))
-	jsonResp = "{"
-	for i,val := range vesselIndex{
-		fmt.Println(strconv.Itoa(i) + " - looking at " + val + " for getVessel_byOwner")
-		valueAsBytes, err := stub.GetState(val)
-		if err != nil {
-			errResp = "{\"Error\":\"Failed to get state for " + val + "\"}"
-			return nil, errors.New(errResp)
-		}
-		//fmt.Print("valueAsBytes : ")
-		//fmt.Println(valueAsBytes)
-		json.Unmarshal(valueAsBytes, &valIndex)
-		//fmt.Print("valIndex: ")
-		//fmt.Print(valIndex)
-		if valIndex.OwnerPhoneNumber == ownerPhoneNumber{
-			fmt.Println("Owner found")
-			jsonResp = jsonResp + "\""+ val + "\":" + string(valueAsBytes[:])
-			//fmt.Println("jsonResp inside if")
-			//fmt.Println(jsonResp)
-			if i < len(vesselIndex)-1 {
-				jsonResp = jsonResp + ","
-			}
-		}
-		
+		return nil, err
 	}
-	jsonResp = jsonResp + "}"
-	//fmt.Println("jsonResp : " + jsonResp)
-	//fmt.Print("jsonResp in bytes : ")
-	//fmt.Println([]byte(jsonResp))
 	fmt.Println("end getVessel_byOwner")
-	return []byte(jsonResp), nil											//send it onward
+	return collectVessels(stub, vesselIDs, func(res Vessel) bool { return res.OwnerPhoneNumber == ownerPhoneNumber })
 }
 
 // ============================================================================================================================
-//  get_AllVessel- get details of all Vessel from chaincode state
+//  get_AllVessel- get one page of all Vessel from chaincode state, in vessel ID order
 // ============================================================================================================================
 func (t *ManageVessel) get_AllVessel(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var jsonResp, errResp string
-	var vesselIndex []string
 	fmt.Println("start get_AllVessel")
-	var err error
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1 argument")
-	}
-	vesselAsBytes, err := stub.GetState(VesselIndexStr)
+	pageSize, bookmark, err := parsePageArgs(args)
 	if err != nil {
-		return nil, errors.New("Failed to get Vessel index")
+		return nil, err
 	}
-	//fmt.Print("vesselAsBytes : ")
-	//fmt.Println(vesselAsBytes)
-	json.Unmarshal(vesselAsBytes, &vesselIndex)								//un stringify it aka JSON.parse()
-	//fmt.Print("poIndex : ")
-	//fmt.Println(poIndex)
-	jsonResp = "{"
-	for i,val := range vesselIndex{
-		fmt.Println(strconv.Itoa(i) + " - looking at " + val + " for all Vessel")
-		valueAsBytes, err := stub.GetState(val)
-		if err != nil {
-			errResp = "{\"Error\":\"Failed to get state for " + val + "\"}"
-			return nil, errors.New(errResp)
-		}
-		//fmt.Print("valueAsBytes : ")
-		//fmt.Println(valueAsBytes)
-		jsonResp = jsonResp + "\""+ val + "\":" + string(valueAsBytes[:])
-		if i < len(vesselIndex)-1 {
-			jsonResp = jsonResp + ","
-		}
+	vesselIndex, err := getVesselIndex(stub)
+	if err != nil {
+		return nil, err
 	}
-	//fmt.Println("len(poIndex) : ")
-	//fmt.Println(len(poIndex))
-	jsonResp = jsonResp + "}"
-	//fmt.Println("jsonResp : " + jsonResp)
-	//fmt.Print("jsonResp in bytes : ")
-	//fmt.Println([]byte(jsonResp))
 	fmt.Println("end get_AllVessel")
-	return []byte(jsonResp), nil
-											//send it onward
+	return readVesselPage(stub, vesselIndex, pageSize, bookmark)
 }
 // ============================================================================================================================
 // Delete - remove a Vessel from chain
@@ -276,55 +246,64 @@ func (t *ManageVessel) delete_vessel(stub shim.ChaincodeStubInterface, args []st
 	}
 	// set vesselID
 	vesselID := args[0]
-
-	//get the Vessel index
-	vesselAsBytes, err := stub.GetState(VesselIndexStr)
+	vesselAsBytes, err := stub.GetState(vesselID)
 	if err != nil {
-		return nil, errors.New("Failed to get Vessel index")
-	}
-	//fmt.Println("poAsBytes in delete po")
-	//fmt.Println(poAsBytes);
-	var vesselIndex []string
-	json.Unmarshal(vesselAsBytes, &vesselIndex)								//un stringify it aka JSON.parse()
-	//fmt.Println("poIndex in delete po")
-	//fmt.Println(poIndex);
-	//remove marble from index
-	for i,val := range vesselIndex{
-		fmt.Println(strconv.Itoa(i) + " - looking at " + val + " for " + vesselID)
-		if val == vesselID{															//find the correct Vessel
-			fmt.Println("found Vessel with matching vesselID")
-			vesselIndex = append(vesselIndex[:i], vesselIndex[i+1:]...)			//remove it
-			for x:= range vesselIndex{											//debug prints...
-				fmt.Println(string(x) + " - " + vesselIndex[x])
-			}
-			break
+		return nil, errors.New("Failed to get state for " + vesselID)
+	}
+	if vesselAsBytes == nil {
+		return nil, newError(ERR_NOT_FOUND, "Vessel " + vesselID + " not found")
+	}
+	res := Vessel{}
+	json.Unmarshal(vesselAsBytes, &res)
+	err = stub.DelState(vesselID)													//remove the Vessel from chaincode
+	if err != nil {
+		return nil, errors.New("Failed to delete state")
+	}
+	if res.VesselID == vesselID {
+		err = updateVesselIndexes(stub, &res, nil)
+		if err != nil {
+			return nil, err
 		}
 	}
-	jsonAsBytes, _ := json.Marshal(vesselIndex)									//save new index
-	err = stub.PutState(VesselIndexStr, jsonAsBytes)
+	err = removeLegacyVesselKey(stub, vesselID)						//only touches data not yet migrated by migrate_vessel_index
+	if err != nil {
+		return nil, err
+	}
 	return nil, nil
 }
 // ============================================================================================================================
 // Write - update Vessel into chaincode state
 // ============================================================================================================================
 func (t *ManageVessel) update_vessel(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var jsonResp string
 	var err error
 	fmt.Println("start update_vessel")
-	if len(args) != 16 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 15.")
+	if len(args) == 1 {
+		args, err = payloadToArgs(args[0], vesselOrder, vesselSchema)
+		if err != nil {
+			return nil, err
+		}
+	} else if len(args) == 21 {
+		fmt.Println("update_vessel: positional arguments are deprecated, pass a single JSON document instead")
+	} else {
+		return nil, errors.New("Incorrect number of arguments. Expecting a single JSON document (or 21 positional arguments, deprecated).")
+	}
+	err = sanitizeArgs(args)
+	if err != nil {
+		return nil, err
 	}
 	// set vesselID
 	vesselID := args[0]
 	vesselAsBytes, err := stub.GetState(vesselID)									//get the Vessel for the specified vesselID from chaincode state
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + vesselID + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, errors.New("Failed to get state for " + vesselID)
 	}
 	//fmt.Print("vesselAsBytes in update vessel")
 	//fmt.Println(vesselAsBytes);
 	res := Vessel{}
-	json.Unmarshal(vesselAsBytes, &res)
+	err = json.Unmarshal(vesselAsBytes, &res)
+	if vesselAsBytes != nil && err != nil {
+		return nil, errors.New("Vessel " + vesselID + " is malformed, run repair_vessel_records")
+	}
 	if res.VesselID == vesselID{
 		fmt.Println("Vessel found with vesselID : " + vesselID)
 		//fmt.Println(res);
@@ -343,30 +322,15 @@ func (t *ManageVessel) update_vessel(stub shim.ChaincodeStubInterface, args []st
 		res.OwnerPostCode = args[13]
 		res.OwnerCountry = args[14]
 		res.VesselClass = args[15]
-		res.BerthBookingStatus = "New"
+		res.LOA, res.Beam, res.Draft, res.GT, res.DWT, err = parseDimensions(args[16:21])
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, newError(ERR_NOT_FOUND, "Vessel " + vesselID + " not found")
 	}
-	
-	//build the Vessel json string manually
-	vesselDetails := 	`{`+
-		`"vesselID": "` + res.VesselID + `" , `+
-		`"vesselName": "` + res.VesselName + `" , `+
-		`"vesselType": "` + res.VesselType + `" , `+
-		`"sin": "` + res.SIN + `" , `+
-		`"mmsiNumber": "` + res.MMSInumber + `" , `+ 
-		`"portOfRegisteration": "` + res.PortOfRegisteration + `" , `+ 
-		`"ownerName": "` + res.OwnerName + `" , `+ 
-		`"ownerPhoneNumber": "` + res.OwnerPhoneNumber + `" , `+ 
-		`"ownerAddressLine1": "` + res.OwnerAddressLine1 + `" , `+ 
-		`"ownerAddressLine2": "` + res.OwnerAddressLine2 + `" , `+ 
-		`"ownerAddressLine3": "` + res.OwnerAddressLine3 + `" , `+ 
-		`"ownerCity": "` +  res.OwnerCity + `", `+ 
-		`"ownerState": "` + res.OwnerState + `" , `+ 
-		`"ownerPostCode": "` + res.OwnerPostCode + `" , `+ 
-		`"ownerCountry": "` +  res.OwnerCountry + `" , `+ 
-		`"vesselClass": "` +  res.VesselClass + `" , `+
-		`"berthBookingStatus": "` +  res.BerthBookingStatus + `" `+ 
-		`}`
-	err = stub.PutState(vesselID, []byte(vesselDetails))									//store Vessel with id as key
+
+	err = saveVessel(stub, res)												//store Vessel with vesselID as key
 	if err != nil {
 		return nil, err
 	}
@@ -377,8 +341,19 @@ func (t *ManageVessel) update_vessel(stub shim.ChaincodeStubInterface, args []st
 // ============================================================================================================================
 func (t *ManageVessel) create_vessel(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var err error
-	if len(args) != 16 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 15")
+	if len(args) == 1 {
+		args, err = payloadToArgs(args[0], vesselOrder, vesselSchema)
+		if err != nil {
+			return nil, err
+		}
+	} else if len(args) == 21 {
+		fmt.Println("create_vessel: positional arguments are deprecated, pass a single JSON document instead")
+	} else {
+		return nil, errors.New("Incorrect number of arguments. Expecting a single JSON document (or 21 positional arguments, deprecated)")
+	}
+	err = sanitizeArgs(args)
+	if err != nil {
+		return nil, err
 	}
 	fmt.Println("start create_vessel")
 
@@ -398,7 +373,11 @@ func (t *ManageVessel) create_vessel(stub shim.ChaincodeStubInterface, args []st
 	OwnerPostCode := args[13]
 	OwnerCountry := args[14]
 	VesselClass := args[15]
-	BerthBookingStatus := "New"
+	BerthBookingStatus := STATUS_NEW
+	LOA, Beam, Draft, GT, DWT, err := parseDimensions(args[16:21])
+	if err != nil {
+		return nil, err
+	}
 	
 	vesselAsBytes, err := stub.GetState(VesselID)
 	if err != nil {
@@ -410,117 +389,135 @@ func (t *ManageVessel) create_vessel(stub shim.ChaincodeStubInterface, args []st
 	json.Unmarshal(vesselAsBytes, &res)
 	//fmt.Print("res: ")
 	//fmt.Println(res)
-	if res.VesselID == VesselID{
+	if vesselAsBytes != nil {
 		//fmt.Println("This Vessel arleady exists: " + VesselID)
 		//fmt.Println(res);
-		return nil, errors.New("This Vessel arleady exists")				//all stop a Vessel by this name exists
+		return nil, newError(ERR_ALREADY_EXISTS, "This Vessel arleady exists")				//all stop a Vessel by this name exists
 	}
-	
-	//build the Vessel json string manually
-	vesselDetails := 	`{`+
-		`"vesselID": "` + VesselID + `" , `+
-		`"vesselName": "` + VesselName + `" , `+
-		`"vesselType": "` + VesselType + `" , `+
-		`"sin": "` + SIN + `" , `+
-		`"mmsiNumber": "` + MMSInumber + `" , `+ 
-		`"portOfRegisteration": "` + PortOfRegisteration + `" , `+ 
-		`"ownerName": "` + OwnerName + `" , `+ 
-		`"ownerPhoneNumber": "` + OwnerPhoneNumber + `" , `+ 
-		`"ownerAddressLine1": "` + OwnerAddressLine1 + `" , `+ 
-		`"ownerAddressLine2": "` + OwnerAddressLine2 + `" , `+ 
-		`"ownerAddressLine3": "` + OwnerAddressLine3 + `" , `+ 
-		`"ownerCity": "` +  OwnerCity + `", `+ 
-		`"ownerState": "` + OwnerState + `" , `+ 
-		`"ownerPostCode": "` + OwnerPostCode + `" , `+ 
-		`"ownerCountry": "` +  OwnerCountry + `" , `+ 
-		`"vesselClass": "` + VesselClass + `" , `+
-		`"berthBookingStatus": "` + BerthBookingStatus + `" `+
-		`}`
 
-		//fmt.Println("vesselDetails: " + vesselDetails)
-		fmt.Print("Vessel details in bytes array: ")
-		fmt.Println([]byte(vesselDetails))
-	err = stub.PutState(VesselID, []byte(vesselDetails))									//store Vessel with VesselID as key
+	res = Vessel{
+		VesselID: VesselID,
+		VesselName: VesselName,
+		VesselType: VesselType,
+		SIN: SIN,
+		MMSInumber: MMSInumber,
+		PortOfRegisteration: PortOfRegisteration,
+		OwnerName: OwnerName,
+		OwnerPhoneNumber: OwnerPhoneNumber,
+		OwnerAddressLine1: OwnerAddressLine1,
+		OwnerAddressLine2: OwnerAddressLine2,
+		OwnerAddressLine3: OwnerAddressLine3,
+		OwnerCity: OwnerCity,
+		OwnerState: OwnerState,
+		OwnerPostCode: OwnerPostCode,
+		OwnerCountry: OwnerCountry,
+		VesselClass: VesselClass,
+		BerthBookingStatus: BerthBookingStatus,
+		LOA: LOA,
+		Beam: Beam,
+		Draft: Draft,
+		GT: GT,
+		DWT: DWT,
+	}
+	actor, err := getActor(stub)
 	if err != nil {
 		return nil, err
 	}
-	//get the Vessel index
-	vesselIndexAsBytes, err := stub.GetState(VesselIndexStr)
-	if err != nil {
-		return nil, errors.New("Failed to get Vessel index")
-	}
-	var vesselIndex []string
-	//fmt.Print("vesselIndexAsBytes: ")
-	//fmt.Println(vesselIndexAsBytes)
-	
-	json.Unmarshal(vesselIndexAsBytes, &vesselIndex)							//un stringify it aka JSON.parse()
-	//fmt.Print("poIndex after unmarshal..before append: ")
-	//fmt.Println(poIndex)
-	//append
-	vesselIndex = append(vesselIndex, VesselID)									//add Vessel transID to index list
-	//fmt.Println("! Vessel index after appending transId: ", poIndex)
-	jsonAsBytes, _ := json.Marshal(vesselIndex)
-	//fmt.Print("jsonAsBytes: ")
-	//fmt.Println(jsonAsBytes)
-	err = stub.PutState(VesselIndexStr, jsonAsBytes)						//store name of Vessel
+	res.CreatedBy = actor.ID()
+	res.CreatedAt = actor.Time
+	err = saveVessel(stub, res)												//store Vessel with VesselID as key
 	if err != nil {
 		return nil, err
 	}
-
 	fmt.Println("end create_vessel")
 	return nil, nil
 }
 
 // ============================================================================================================================
-// Write - update Vessel into chaincode state
+// update_vessel_allocationStatus - move a vessel to the status of one of its bookings, the booking is read from the
+// Berth chaincode, must belong to the caller and must already be in that status. Only the booking holding the vessel
+// moves it, see checkVesselStatusTransition.
 // ============================================================================================================================
 func (t *ManageVessel) update_vessel_allocationStatus(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var jsonResp string
 	var err error
 	fmt.Println("start update_vessel_allocationStatus")
-	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2.")
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3: vesselID, status, bookingID")
+	}
+	err = sanitizeArgs(args)
+	if err != nil {
+		return nil, err
 	}
 	// set vesselID
 	vesselID := args[0]
+	booking, err := fetchBooking(stub, args[2])
+	if err != nil {
+		return nil, err
+	}
+	if booking.VesselID != vesselID {
+		return nil, &ChaincodeError{ResponseError{Code: ERR_CONFLICT, Message: "Booking " + booking.BookingID + " is not a port call of vessel " + vesselID, Field: "bookingID"}}
+	}
+	if booking.BerthBookingStatus != args[1] {									//the workflow moves the booking first, the vessel follows it
+		return nil, &ChaincodeError{ResponseError{Code: ERR_CONFLICT, Message: "Booking " + booking.BookingID + " is '" + booking.BerthBookingStatus + "', the vessel cannot move to '" + args[1] + "' ahead of it", Field: "status"}}
+	}
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = checkStatusPermission(caller, booking, args[1])
+	if err != nil {
+		return nil, err
+	}
 	vesselAsBytes, err := stub.GetState(vesselID)									//get the Vessel for the specified vesselID from chaincode state
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + vesselID + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, errors.New("Failed to get state for " + vesselID)
 	}
 	//fmt.Print("vesselAsBytes in update vessel")
 	//fmt.Println(vesselAsBytes);
 	res := Vessel{}
-	json.Unmarshal(vesselAsBytes, &res)
+	err = json.Unmarshal(vesselAsBytes, &res)
+	if vesselAsBytes != nil && err != nil {
+		return nil, errors.New("Vessel " + vesselID + " is malformed, run repair_vessel_records")
+	}
 	if res.VesselID == vesselID{
 		fmt.Println("Vessel found with vesselID : " + vesselID)
 		//fmt.Println(res);
+		err = checkVesselStatusTransition(res, booking.BookingID, args[1])
+		if err != nil {
+			return nil, err
+		}
 		res.BerthBookingStatus = args[1]
+		res.ActiveBookingID = booking.BookingID						//the booking holds the vessel until it is finished
+		if finishedStatus(args[1]) {
+			res.ActiveBookingID = ""
+		}
+	} else {
+		return nil, newError(ERR_NOT_FOUND, "Vessel " + vesselID + " not found")
 	}
-	
-	//build the Vessel json string manually
-	vesselDetails := 	`{`+
-		`"vesselID": "` + res.VesselID + `" , `+
-		`"vesselName": "` + res.VesselName + `" , `+
-		`"vesselType": "` + res.VesselType + `" , `+
-		`"sin": "` + res.SIN + `" , `+
-		`"mmsiNumber": "` + res.MMSInumber + `" , `+ 
-		`"portOfRegisteration": "` + res.PortOfRegisteration + `" , `+ 
-		`"ownerName": "` + res.OwnerName + `" , `+ 
-		`"ownerPhoneNumber": "` + res.OwnerPhoneNumber + `" , `+ 
-		`"ownerAddressLine1": "` + res.OwnerAddressLine1 + `" , `+ 
-		`"ownerAddressLine2": "` + res.OwnerAddressLine2 + `" , `+ 
-		`"ownerAddressLine3": "` + res.OwnerAddressLine3 + `" , `+ 
-		`"ownerCity": "` +  res.OwnerCity + `", `+ 
-		`"ownerState": "` + res.OwnerState + `" , `+ 
-		`"ownerPostCode": "` + res.OwnerPostCode + `" , `+ 
-		`"ownerCountry": "` +  res.OwnerCountry + `" , `+ 
-		`"vesselClass": "` +  res.VesselClass + `" , `+
-		`"berthBookingStatus": "` +  res.BerthBookingStatus + `" `+ 
-		`}`
-	err = stub.PutState(vesselID, []byte(vesselDetails))									//store Vessel with id as key
+
+	err = saveVessel(stub, res)												//store Vessel with vesselID as key
 	if err != nil {
 		return nil, err
 	}
 	return nil, nil
 }
+
+// ============================================================================================================================
+// parseDimensions - read LOA, beam, draft, GT and DWT from their positional arguments
+// ============================================================================================================================
+func parseDimensions(args []string) (float64, float64, float64, float64, float64, error) {
+	names := []string{"LOA", "Beam", "Draft", "GT", "DWT"}
+	values := make([]float64, len(names))
+	for i, name := range names {
+		value, err := strconv.ParseFloat(strings.TrimSpace(args[i]), 64)
+		if err != nil || value < 0 {
+			return 0, 0, 0, 0, 0, newError(ERR_INVALID_ARGUMENT, name + " must be a non-negative number, got '" + args[i] + "'")
+		}
+		if value == 0 && i < 3 {
+			return 0, 0, 0, 0, 0, newError(ERR_INVALID_ARGUMENT, name + " must be greater than zero")
+		}
+		values[i] = value
+	}
+	return values[0], values[1], values[2], values[3], values[4], nil
+}
+
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// memoryStub keeps the world state in a map, reads the caller's certificate attributes from another and answers
+// Berth booking queries from a third. Stub functions the tests do not use are left to the embedded interface.
+type memoryStub struct {
+	shim.ChaincodeStubInterface
+	state    map[string][]byte
+	attrs    map[string]string
+	bookings map[string]Booking
+}
+
+func newMemoryStub(role string) *memoryStub {
+	return &memoryStub{state: map[string][]byte{}, attrs: map[string]string{"role": role, "org": "DPW", "userID": "tester"}, bookings: map[string]Booking{}}
+}
+
+func (m *memoryStub) GetState(key string) ([]byte, error) { return m.state[key], nil }
+func (m *memoryStub) PutState(key string, value []byte) error {
+	m.state[key] = value
+	return nil
+}
+func (m *memoryStub) DelState(key string) error {
+	delete(m.state, key)
+	return nil
+}
+func (m *memoryStub) ReadCertAttribute(name string) ([]byte, error) {
+	return []byte(m.attrs[name]), nil
+}
+func (m *memoryStub) GetCallerCertificate() ([]byte, error) { return nil, nil }
+
+func (m *memoryStub) QueryChaincode(chaincodeName string, args [][]byte) ([]byte, error) {
+	res, ok := m.bookings[string(args[1])]
+	if string(args[0]) != "getBerth_byBookingID" || !ok {
+		return respond(nil, newError(ERR_NOT_FOUND, "Booking "+string(args[1])+" not found"))
+	}
+	bookingAsBytes, _ := json.Marshal(res)
+	return respond(bookingAsBytes, nil)
+}
+
+func (m *memoryStub) RangeQueryState(startKey string, endKey string) (shim.StateRangeQueryIteratorInterface, error) {
+	keys := []string{}
+	for key := range m.state {
+		if key >= startKey && key < endKey {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return &memoryIterator{stub: m, keys: keys}, nil
+}
+
+type memoryIterator struct {
+	stub *memoryStub
+	keys []string
+}
+
+func (it *memoryIterator) HasNext() bool { return len(it.keys) > 0 }
+func (it *memoryIterator) Next() (string, []byte, error) {
+	key := it.keys[0]
+	it.keys = it.keys[1:]
+	return key, it.stub.state[key], nil
+}
+func (it *memoryIterator) Close() error { return nil }
+
+// putVessel - store a vessel and its index entries the way saveVessel does, without the signer stamp
+func putVessel(t *testing.T, stub *memoryStub, res Vessel) {
+	vesselAsBytes, _ := json.Marshal(res)
+	stub.PutState(res.VesselID, vesselAsBytes)
+	err := updateVesselIndexes(stub, nil, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// responseCode - the error code of a response envelope, empty when the call succeeded
+func responseCode(payload []byte, err error) string {
+	if err == nil {
+		return ""
+	}
+	response := Response{}
+	message := err.Error()
+	if json.Unmarshal([]byte(message[strings.Index(message, "{"):]), &response) != nil || response.Error == nil {
+		return message
+	}
+	return response.Error.Code
+}
+
+func TestDeleteVesselRemovesRecord(t *testing.T) {
+	stub := newMemoryStub(ROLE_ADMIN)
+	cc := new(ManageVessel)
+	putVessel(t, stub, Vessel{VesselID: "IMO9321483", VesselName: "Maersk Essen", OwnerPhoneNumber: "0501234567"})
+	putVessel(t, stub, Vessel{VesselID: "IMO9454412", VesselName: "MSC Daniela", OwnerPhoneNumber: "0501234567"})
+
+	_, err := cc.Invoke(stub, "delete_vessel", []string{"IMO9321483"})
+	if err != nil {
+		t.Fatalf("delete_vessel failed: %s", err)
+	}
+
+	if code := responseCode(cc.Query(stub, "getVessel_byID", []string{"IMO9321483"})); code != ERR_NOT_FOUND {
+		t.Errorf("getVessel_byID after delete_vessel = %q, want %s", code, ERR_NOT_FOUND)
+	}
+	if _, ok := stub.state["IMO9321483"]; ok {
+		t.Error("vessel record still on the ledger after delete_vessel")
+	}
+	vesselIDs, err := lookupVesselIndex(stub, "owner", "0501234567")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vesselIDs) != 1 || vesselIDs[0] != "IMO9454412" {
+		t.Errorf("owner index after delete_vessel = %v, want [IMO9454412]", vesselIDs)
+	}
+	if code := responseCode(cc.Query(stub, "getVessel_byID", []string{"IMO9454412"})); code != "" {
+		t.Errorf("getVessel_byID of the other vessel = %q, want it found", code)
+	}
+}
+
+func TestDeleteVesselNotFound(t *testing.T) {
+	stub := newMemoryStub(ROLE_ADMIN)
+	if code := responseCode(new(ManageVessel).Invoke(stub, "delete_vessel", []string{"IMO0000000"})); code != ERR_NOT_FOUND {
+		t.Errorf("delete_vessel of an unknown vessel = %q, want %s", code, ERR_NOT_FOUND)
+	}
+}
+
+func TestVesselFollowsItsActiveBooking(t *testing.T) {
+	res := Vessel{VesselID: "IMO9321483", BerthBookingStatus: STATUS_APPROVED, ActiveBookingID: "BK1"}
+
+	if err := checkVesselStatusTransition(res, "BK2", STATUS_CANCELLED); !hasCode(err, ERR_CONFLICT) {
+		t.Errorf("booking BK2 moving a vessel held by BK1: got %v, want %s", err, ERR_CONFLICT)
+	}
+	if err := checkVesselStatusTransition(res, "BK1", STATUS_BERTHED); err != nil {
+		t.Errorf("booking BK1 berthing its vessel: got %v, want no error", err)
+	}
+	if err := checkVesselStatusTransition(res, "BK1", STATUS_IN_PROGRESS); !hasCode(err, ERR_CONFLICT) {
+		t.Errorf("booking BK1 moving its vessel back: got %v, want %s", err, ERR_CONFLICT)
+	}
+
+	res.ActiveBookingID = ""
+	if err := checkVesselStatusTransition(res, "BK2", STATUS_IN_PROGRESS); err != nil {
+		t.Errorf("booking BK2 taking a free vessel: got %v, want no error", err)
+	}
+}
+
+func TestVesselStatusFollowsBooking(t *testing.T) {
+	stub := newMemoryStub(ROLE_ADMIN)
+	cc := new(ManageVessel)
+	stub.state[ChaincodeRefsKey], _ = json.Marshal(ChaincodeRefs{BerthChaincode: "berth"})
+	putVessel(t, stub, Vessel{VesselID: "IMO9321483", VesselName: "Maersk Essen", BerthBookingStatus: STATUS_APPROVED, ActiveBookingID: "BK1"})
+	stub.bookings["BK1"] = Booking{BookingID: "BK1", VesselID: "IMO9321483", BerthBookingStatus: STATUS_APPROVED}
+
+	// The booking is still Approved, so the vessel may not be moved to Berthed on its own
+	code := responseCode(cc.Invoke(stub, "update_vessel_allocationStatus", []string{"IMO9321483", STATUS_BERTHED, "BK1"}))
+	if code != ERR_CONFLICT {
+		t.Errorf("update_vessel_allocationStatus ahead of its booking = %q, want %s", code, ERR_CONFLICT)
+	}
+	res, err := getVessel(stub, "IMO9321483")
+	if err != nil || res == nil {
+		t.Fatalf("getVessel failed: %v", err)
+	}
+	if res.BerthBookingStatus != STATUS_APPROVED || res.ActiveBookingID != "BK1" {
+		t.Errorf("vessel after a refused move is '%s' held by %q, want '%s' held by BK1", res.BerthBookingStatus, res.ActiveBookingID, STATUS_APPROVED)
+	}
+}
+
+func TestInitRecordsBerthChaincode(t *testing.T) {
+	stub := newMemoryStub(ROLE_ADMIN)
+	cc := new(ManageVessel)
+	if code := responseCode(cc.Init(stub, "init", []string{"hello"})); code == "" {
+		t.Error("Init without the Berth chaincode succeeded, want it refused")
+	}
+	_, err := cc.Init(stub, "init", []string{"hello", "berth"})
+	if err != nil {
+		t.Fatalf("Init failed: %s", err)
+	}
+	name, err := berthChaincode(stub)
+	if err != nil || name != "berth" {
+		t.Errorf("berthChaincode after Init = %q, %v, want berth", name, err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Secondary indexes are stored as composite keys
+//	_VesselIdx <sep> index name <sep> field value <sep> vessel ID
+// so every vessel with a given value sits in one contiguous key range. The separator is U+0000, which
+// sanitizeArgs keeps out of every stored field.
+var VesselIndexPrefix = "_VesselIdx"
+var IndexSeparator = "\x00"
+
+type vesselFieldIndex struct { // A secondary index over one vessel field
+	name  string
+	field func(Vessel) string
+}
+
+var vesselIndexes = []vesselFieldIndex{
+	{"all", func(res Vessel) string { return "*" }},		// every vessel, for listings
+	{"owner", func(res Vessel) string { return res.OwnerPhoneNumber }},
+}
+
+// ============================================================================================================================
+// vesselIndexPrefix - start of the key range holding every vessel with the given value in an index
+// ============================================================================================================================
+func vesselIndexPrefix(name string, value string) string {
+	return VesselIndexPrefix + IndexSeparator + name + IndexSeparator + value + IndexSeparator
+}
+
+// ============================================================================================================================
+// updateVesselIndexes - move a vessel's index entries from its old field values to its new ones, either side may be nil
+// ============================================================================================================================
+func updateVesselIndexes(stub shim.ChaincodeStubInterface, old *Vessel, res *Vessel) error {
+	for _, index := range vesselIndexes {
+		oldValue, newValue := "", ""
+		if old != nil {
+			oldValue = index.field(*old)
+		}
+		if res != nil {
+			newValue = index.field(*res)
+		}
+		if old != nil && res != nil && oldValue == newValue && old.VesselID == res.VesselID {
+			continue
+		}
+		if old != nil && oldValue != "" {
+			err := stub.DelState(vesselIndexPrefix(index.name, oldValue) + old.VesselID)
+			if err != nil {
+				return errors.New("Failed to remove " + index.name + " index entry for " + old.VesselID)
+			}
+		}
+		if res != nil && newValue != "" {
+			err := stub.PutState(vesselIndexPrefix(index.name, newValue)+res.VesselID, []byte(res.VesselID))
+			if err != nil {
+				return errors.New("Failed to write " + index.name + " index entry for " + res.VesselID)
+			}
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// lookupVesselIndex - get the vessel IDs recorded under a value of an index, in key order
+// ============================================================================================================================
+func lookupVesselIndex(stub shim.ChaincodeStubInterface, name string, value string) ([]string, error) {
+	prefix := vesselIndexPrefix(name, value)
+	keysIter, err := stub.RangeQueryState(prefix, prefix+string(utf8.MaxRune))
+	if err != nil {
+		return nil, errors.New("Failed to scan " + name + " index")
+	}
+	defer keysIter.Close()
+	vesselIDs := []string{}
+	for keysIter.HasNext() {
+		key, _, err := keysIter.Next()
+		if err != nil {
+			return nil, errors.New("Failed to scan " + name + " index")
+		}
+		vesselIDs = append(vesselIDs, key[len(prefix):])
+	}
+	return vesselIDs, nil
+}
+
+// ============================================================================================================================
+// getVesselIndex - get the keys of every vessel in key order, including any still listed only in the legacy index
+// ============================================================================================================================
+func getVesselIndex(stub shim.ChaincodeStubInterface) ([]string, error) {
+	vesselIDs, err := lookupVesselIndex(stub, "all", "*")
+	if err != nil {
+		return nil, err
+	}
+	legacyIDs, err := getLegacyKeys(stub)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	keys := []string{}
+	for _, key := range append(vesselIDs, legacyIDs...) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// ============================================================================================================================
+// getLegacyKeys - read the JSON array index used before the composite key indexes
+// ============================================================================================================================
+func getLegacyKeys(stub shim.ChaincodeStubInterface) ([]string, error) {
+	var keys []string
+	keysAsBytes, err := stub.GetState(VesselIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get Vessel index")
+	}
+	json.Unmarshal(keysAsBytes, &keys)
+	return keys, nil
+}
+
+// ============================================================================================================================
+// putLegacyKeys - write back the legacy JSON array index, dropping the key altogether once it is empty
+// ============================================================================================================================
+func putLegacyKeys(stub shim.ChaincodeStubInterface, keys []string) error {
+	if len(keys) == 0 {
+		return stub.DelState(VesselIndexStr)
+	}
+	jsonAsBytes, _ := json.Marshal(keys)
+	return stub.PutState(VesselIndexStr, jsonAsBytes)
+}
+
+// ============================================================================================================================
+// removeLegacyVesselKey - drop a deleted vessel from the legacy index, without writing it unless the vessel is listed
+// ============================================================================================================================
+func removeLegacyVesselKey(stub shim.ChaincodeStubInterface, vesselID string) error {
+	keys, err := getLegacyKeys(stub)
+	if err != nil {
+		return err
+	}
+	for i, key := range keys {
+		if key == vesselID {
+			return putLegacyKeys(stub, append(keys[:i], keys[i+1:]...))
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// migrate_vessel_index - one-off move from the shared JSON array index to per-vessel index keys. Vessels that
+// cannot be read stay in the legacy index for repair_vessel_records; run this again once they are fixed.
+// ============================================================================================================================
+func (t *ManageVessel) migrate_vessel_index(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("start migrate_vessel_index")
+	legacyIDs, err := getLegacyKeys(stub)
+	if err != nil {
+		return nil, err
+	}
+	migrated, kept := []string{}, []string{}
+	for _, key := range legacyIDs {
+		res, err := getVessel(stub, key)
+		if err == nil && res == nil {									//never stored, nothing to index
+			continue
+		}
+		if err != nil || res.VesselID != key {
+			kept = append(kept, key)
+			continue
+		}
+		err = updateVesselIndexes(stub, nil, res)
+		if err != nil {
+			return nil, err
+		}
+		migrated = append(migrated, key)
+	}
+	err = putLegacyKeys(stub, kept)
+	if err != nil {
+		return nil, err
+	}
+	report, _ := json.Marshal(map[string][]string{"migrated": migrated, "kept": kept})
+	fmt.Println("end migrate_vessel_index")
+	return report, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var DefaultPageSize = 50
+var MaxPageSize = 500
+
+type VesselPage struct { // One page of a vessel listing
+	Records    []Vessel `json:"records"`
+	Count      int     `json:"count"`      // records on this page
+	TotalCount int     `json:"totalCount"` // records in the whole listing
+	Bookmark   string  `json:"bookmark"`   // pass back to get the next page, empty on the last page
+}
+
+// ============================================================================================================================
+// parsePageArgs - read the optional page size and bookmark of a listing query. A single non-numeric argument is the
+// placeholder older clients pass and is ignored.
+// ============================================================================================================================
+func parsePageArgs(args []string) (int, string, error) {
+	pageSize := DefaultPageSize
+	bookmark := ""
+	if len(args) > 2 {
+		return 0, "", errors.New("Incorrect number of arguments. Expecting an optional page size and bookmark")
+	}
+	if len(args) >= 1 && strings.TrimSpace(args[0]) != "" {
+		size, err := strconv.Atoi(strings.TrimSpace(args[0]))
+		if err != nil && len(args) == 1 {
+			fmt.Println("ignoring legacy listing argument '" + args[0] + "'")
+			return pageSize, bookmark, nil
+		}
+		if err != nil || size < 1 || size > MaxPageSize {
+			return 0, "", newError(ERR_INVALID_ARGUMENT, "Page size must be a number from 1 to " + strconv.Itoa(MaxPageSize))
+		}
+		pageSize = size
+	}
+	if len(args) == 2 {
+		bookmark = args[1]
+	}
+	return pageSize, bookmark, nil
+}
+
+// ============================================================================================================================
+// pageKeys - the keys of one page of a sorted key list, starting after the bookmark, and the bookmark of the next page
+// ============================================================================================================================
+func pageKeys(keys []string, pageSize int, bookmark string) ([]string, string) {
+	start := 0
+	if bookmark != "" {
+		start = sort.SearchStrings(keys, bookmark)
+		if start < len(keys) && keys[start] == bookmark {
+			start++
+		}
+	}
+	end := start + pageSize
+	if end >= len(keys) {
+		return keys[start:], ""
+	}
+	return keys[start:end], keys[end-1]
+}
+
+// ============================================================================================================================
+// readVesselPage - read the vessels of one page, malformed records are logged and left out
+// ============================================================================================================================
+func readVesselPage(stub shim.ChaincodeStubInterface, keys []string, pageSize int, bookmark string) ([]byte, error) {
+	page := VesselPage{Records: []Vessel{}, TotalCount: len(keys)}
+	var pageOfKeys []string
+	pageOfKeys, page.Bookmark = pageKeys(keys, pageSize, bookmark)
+	for _, key := range pageOfKeys {
+		res, err := getVessel(stub, key)
+		if err != nil {
+			fmt.Println("skipping vessel " + key + ": " + err.Error())
+			continue
+		}
+		if res != nil {
+			page.Records = append(page.Records, *res)
+		}
+	}
+	page.Count = len(page.Records)
+	return json.Marshal(page)
+}